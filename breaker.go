@@ -0,0 +1,104 @@
+package loggly
+
+import "errors"
+import "sync"
+import "time"
+
+// ErrCircuitOpen is returned by flushes while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("loggly: circuit open")
+
+// BreakerState of the circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed allows flushes.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen short-circuits flushes until the cooldown elapses.
+	BreakerOpen
+
+	// BreakerHalfOpen allows a single probe request.
+	BreakerHalfOpen
+)
+
+// Circuit breaker state.
+type breaker struct {
+	state    BreakerState
+	failures int
+	opened   time.Time
+	sync.Mutex
+}
+
+// Check the breaker before a flush, moving from open to
+// half-open once the cooldown has elapsed.
+func (c *Client) allowFlush() error {
+	if c.BreakerThreshold <= 0 {
+		return nil
+	}
+
+	c.breaker.Lock()
+	defer c.breaker.Unlock()
+
+	if c.breaker.state == BreakerOpen {
+		if time.Since(c.breaker.opened) < c.cooldown() {
+			return ErrCircuitOpen
+		}
+
+		debug("circuit half-open, probing")
+		c.breaker.state = BreakerHalfOpen
+	}
+
+	return nil
+}
+
+// Record the outcome `err` of a request, reporting whether
+// the circuit is open. Only transient failures count.
+func (c *Client) record(err error) bool {
+	if c.BreakerThreshold <= 0 {
+		return false
+	}
+
+	c.breaker.Lock()
+	defer c.breaker.Unlock()
+
+	if err == nil || !retryable(err) {
+		c.breaker.state = BreakerClosed
+		c.breaker.failures = 0
+		return false
+	}
+
+	c.breaker.failures++
+
+	if c.breaker.state == BreakerHalfOpen || c.breaker.failures >= c.BreakerThreshold {
+		debug("circuit open after %d failures", c.breaker.failures)
+		c.breaker.state = BreakerOpen
+		c.breaker.opened = time.Now()
+	}
+
+	return c.breaker.state == BreakerOpen
+}
+
+// Check if the breaker only allows a probe request.
+func (c *Client) probing() bool {
+	c.breaker.Lock()
+	defer c.breaker.Unlock()
+
+	return c.breaker.state == BreakerHalfOpen
+}
+
+// Return the breaker cooldown.
+func (c *Client) cooldown() time.Duration {
+	if c.BreakerCooldown <= 0 {
+		return 30 * time.Second
+	}
+
+	return c.BreakerCooldown
+}
+
+// Return the breaker state.
+func (c *Client) breakerState() BreakerState {
+	c.breaker.Lock()
+	defer c.breaker.Unlock()
+
+	return c.breaker.state
+}
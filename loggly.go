@@ -2,11 +2,23 @@ package loggly
 
 import . "github.com/visionmedia/go-debug"
 import . "encoding/json"
+import "compress/gzip"
+import "crypto/tls"
+import "hash/fnv"
+import "math/rand"
+import "context"
 import "io/ioutil"
 import "net/http"
+import "net/url"
+import "mime"
+import "runtime"
+import "strconv"
 import "strings"
+import "sort"
+import "errors"
 import "bytes"
 import "time"
+import "log"
 import "sync"
 import "fmt"
 import "os"
@@ -14,7 +26,14 @@ import "io"
 
 const Version = "0.4.3"
 
-const api = "https://logs-01.loggly.com/bulk/{token}"
+// Maximum length of a tag.
+const maxTagLength = 64
+
+// Loggly hosts by region.
+var hosts = map[string]string{
+	"us": "logs-01.loggly.com",
+	"eu": "logs-01.eu.loggly.com",
+}
 
 type Message map[string]interface{}
 
@@ -22,8 +41,91 @@ var debug = Debug("loggly")
 
 var nl = []byte{'\n'}
 
+// ErrClosed is returned when sending to a closed client.
+var ErrClosed = errors.New("loggly: client closed")
+
+// ErrNoToken is returned when the client has no token.
+var ErrNoToken = errors.New("loggly: missing token")
+
+// ErrMissingField is returned for messages lacking one of RequiredFields.
+var ErrMissingField = errors.New("loggly: missing required field")
+
+// ErrInvalidTag is returned for tags loggly would reject with StrictTags.
+var ErrInvalidTag = errors.New("loggly: invalid tag")
+
+// ErrInvalidRequest is returned for a Method or ContentType
+// unsuitable for sending batches. Flushes fail without sending,
+// keeping the messages buffered.
+var ErrInvalidRequest = errors.New("loggly: invalid request")
+
+// ErrFlushPanic wraps a panic recovered from a background flush.
+var ErrFlushPanic = errors.New("loggly: flush panicked")
+
+// Level of a message.
 type Level int
 
+// Format of the bulk request body.
+type Format int
+
+const (
+	// FormatNDJSON sends newline-delimited messages.
+	FormatNDJSON Format = iota
+
+	// FormatJSONArray sends a JSON array of messages.
+	FormatJSONArray
+)
+
+// TimestampFormat of the timestamp added to messages.
+type TimestampFormat int
+
+const (
+	// TimestampMillis formats as milliseconds since the epoch.
+	TimestampMillis TimestampFormat = iota
+
+	// TimestampSeconds formats as seconds since the epoch.
+	TimestampSeconds
+
+	// TimestampRFC3339 formats as an RFC3339 string.
+	TimestampRFC3339
+)
+
+// DurationFormat of time.Duration values in messages.
+type DurationFormat int
+
+const (
+	// DurationString formats as a string such as "1.5s".
+	DurationString DurationFormat = iota
+
+	// DurationMillis formats as fractional milliseconds.
+	DurationMillis
+)
+
+// TagMode controls how tags are sent.
+type TagMode int
+
+const (
+	// TagModeHeader sends tags in the X-Loggly-Tag header.
+	TagModeHeader TagMode = iota
+
+	// TagModePath sends tags as a "/tag/<tags>/" path suffix, for
+	// proxies stripping custom headers.
+	TagModePath
+)
+
+// DropPolicy controls what happens when the buffer is full.
+type DropPolicy int
+
+const (
+	// DropOldest discards the oldest buffered message.
+	DropOldest DropPolicy = iota
+
+	// DropNewest discards the incoming message.
+	DropNewest
+
+	// Block waits until the buffer has room.
+	Block
+)
+
 const (
 	DEBUG Level = iota
 	INFO
@@ -32,36 +134,477 @@ const (
 	FATAL
 )
 
+// Level names accepted in a message's "level" key.
+var levels = map[string]Level{
+	"debug":   DEBUG,
+	"info":    INFO,
+	"warn":    WARNING,
+	"warning": WARNING,
+	"error":   ERROR,
+	"fatal":   FATAL,
+}
+
+// ParseLevel returns the level named `s`, case-insensitive,
+// such as "info" or "warning".
+func ParseLevel(s string) (Level, error) {
+	level, ok := levels[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("loggly: unknown level %q", s)
+	}
+
+	return level, nil
+}
+
+// String returns the lowercase name of the level.
+func (l Level) String() string {
+	switch l {
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case WARNING:
+		return "warning"
+	case ERROR:
+		return "error"
+	case FATAL:
+		return "fatal"
+	default:
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// FlushResult describes the delivery of a batch, see OnFlush.
+type FlushResult struct {
+	// Messages in the batch.
+	Messages int
+
+	// Bytes of the request body, after compression.
+	Bytes int
+
+	// Status of the last response, 0 when no response was received.
+	StatusCode int
+
+	// Requests made, including retries.
+	Attempts int
+
+	// Time spent delivering, including retries.
+	Duration time.Duration
+
+	// Last response, nil when none was received. Its body
+	// has already been read and is replayed from memory.
+	Response *http.Response
+
+	// Error of the last attempt, nil when delivered.
+	Err error
+}
+
+// FlushError is returned when loggly rejects a bulk upload.
+type FlushError struct {
+	// HTTP status code.
+	StatusCode int
+
+	// Response body.
+	Body string
+
+	// Delay requested by a 429 response's Retry-After header.
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("loggly: %d response: %s", e.StatusCode, e.Body)
+}
+
+// Logger is the interface satisfied by *Client, allowing
+// it to be replaced in tests, see package logglytest.
+type Logger interface {
+	Send(Message) error
+	Write([]byte) (int, error)
+	Flush() error
+}
+
+var _ Logger = (*Client)(nil)
+var _ io.WriteCloser = (*Client)(nil)
+
+// Buffered message.
+type entry struct {
+	data  []byte
+	tags  []string
+	key   uint64
+	count int
+	out   []byte
+}
+
 // Loggly client.
 type Client struct {
-	// Optionally output logs to the given writer.
+	// Optionally output logs to the given writer, see also AddWriter.
+	// Reassigning it once logging has started is unsafe.
 	Writer io.Writer
 
+	// Formats messages for Writer and added writers, a newline being
+	// appended, instead of the JSON sent. Raw writes are unaffected.
+	WriterFunc func(Message) []byte
+
 	// Log level defaulting to INFO.
 	Level Level
 
 	// Size of buffer before flushing [100]
 	BufferSize int
 
-	// Flush interval regardless of size [5s]
+	// Buffered bytes before flushing, 0 disables [0]
+	FlushBytes int
+
+	// Maximum buffered messages, 0 is unbounded [0]
+	MaxBufferSize int
+
+	// Maximum bytes of buffered messages, applying DropPolicy like
+	// MaxBufferSize. Larger messages are dropped. 0 is unbounded [0]
+	MaxMemoryBytes int
+
+	// Maximum messages per request, a flush sending larger
+	// buffers in several requests. 0 is unlimited [0]
+	MaxBatchSize int
+
+	// Policy applied when MaxBufferSize is reached [DropOldest]
+	DropPolicy DropPolicy
+
+	// Flush interval regardless of size, see SetFlushInterval. Values
+	// other than positive ones use the default [5s]
 	FlushInterval time.Duration
 
-	// Loggly end-point.
+	// Deadline of background flushes, including retries, after which
+	// the flush is cancelled, its messages requeued and the error
+	// reported to OnError [the larger of FlushInterval and 1m]
+	FlushTimeout time.Duration
+
+	// Replace FlushInterval after each flush with an interval scaled by
+	// how full the buffer was relative to BufferSize, from MaxFlushInterval
+	// when empty down to MinFlushInterval when full.
+	AdaptiveFlush bool
+
+	// Shortest adaptive flush interval [1s]
+	MinFlushInterval time.Duration
+
+	// Longest adaptive flush interval [30s]
+	MaxFlushInterval time.Duration
+
+	// Loggly end-point, see SetToken.
 	Endpoint string
 
-	// Token string.
+	// Base URL of a relay receiving "/bulk/<token>" and "/inputs/<token>"
+	// requests in place of Endpoint and the region's inputs end-point.
+	BaseURL string
+
+	// Token string, use SetToken once logging has started.
 	Token string
 
-	// Default properties.
+	// Region of the end-point [us]
+	Region string
+
+	// Added as the "source" field of messages lacking one when set.
+	Source string
+
+	// Added as the "source_category" field of messages lacking one when set.
+	SourceCategory string
+
+	// Add Version as the "_loggly_client_version" field of messages.
+	IncludeClientVersion bool
+
+	// Buffer a "loggly_client": "started" meta-event when the
+	// client is created, see WithStartupEvent.
+	StartupEvent bool
+
+	// HTTP client used for flushing, defaulting to one with
+	// a 30s timeout using Proxy and TLSConfig.
+	HTTPClient *http.Client
+
+	// Proxy of the default HTTP client, no effect when HTTPClient
+	// is set. Must be set before the first flush [http.ProxyFromEnvironment]
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// TLS configuration of the default HTTP client, such as a custom root
+	// CA pool or client certificates. No effect when HTTPClient is set.
+	// Must be set before the first flush.
+	TLSConfig *tls.Config
+
+	// User-Agent sent with each request ["go-loggly (version: <Version>)"]
+	UserAgent string
+
+	// How tags are sent with requests [TagModeHeader]
+	TagMode TagMode
+
+	// Reject tags loggly does not accept, up to 64 letters, digits,
+	// "-", "." and "_" starting with a letter or digit, returning
+	// ErrInvalidTag. Otherwise they are sanitized.
+	StrictTags bool
+
+	// HTTP method of bulk requests, "POST", "PUT" or "PATCH" ["POST"]
+	Method string
+
+	// Content-Type of bulk requests ["application/json" with
+	// FormatJSONArray, "text/plain" otherwise]
+	ContentType string
+
+	// Extra headers sent with each request, replacing
+	// defaults such as User-Agent of the same name.
+	Headers http.Header
+
+	// Return batches failing transiently after MaxRetries to the front
+	// of the buffer rather than dropping them, so they are delivered in
+	// order. Newer messages wait behind a failing batch, increasing latency,
+	// until it succeeds or is discarded by DropPolicy once MaxBufferSize
+	// is reached. Rejected batches (4xx) are still dropped.
+	PreserveOrder bool
+
+	// Retries of transient flush failures [3]
+	MaxRetries int
+
+	// Base retry backoff, doubled per attempt [500ms]
+	RetryBackoff time.Duration
+
+	// Randomize each backoff between 0 and its full value so
+	// instances recovering together spread their retries [true]
+	Jitter bool
+
+	// Bulk body format, FormatJSONArray requires JSON from Write [FormatNDJSON]
+	Format Format
+
+	// Consecutive transient failures opening the circuit breaker,
+	// short-circuiting flushes during BreakerCooldown. 0 disables [0]
+	BreakerThreshold int
+
+	// Time the circuit stays open before a probe request [30s]
+	BreakerCooldown time.Duration
+
+	// Gzip bodies larger than this many bytes, 0 disables [0]
+	CompressionThreshold int
+
+	// Maximum marshaled event size, 0 is unlimited [0]
+	MaxEventBytes int
+
+	// Add "file" and "line" of the caller to level helper messages.
+	IncludeCaller bool
+
+	// Add the goroutine "stack" to Error and Fatal messages.
+	CaptureStack bool
+
+	// Collapse identical messages within a flush window into
+	// one with a "_count" field, ignoring timestamps.
+	Dedup bool
+
+	// Directory where batches are spooled until delivered,
+	// replayed by later flushes. Empty disables [""]
+	SpoolDir string
+
+	// Maximum bytes spooled, 0 is unlimited [0]
+	MaxSpoolBytes int64
+
+	// Filter raw writes starting with a level such as "[ERROR]".
+	ParseLevelPrefix bool
+
+	// Fraction of messages kept per level, FATAL is always kept [1]
+	SampleRate map[Level]float64
+
+	// Maximum messages per second, excess is dropped. 0 disables [0]
+	RateLimit float64
+
+	// Levels not subject to RateLimit.
+	RateLimitExempt []Level
+
+	// Returns the trace and span IDs of a context for SendContext,
+	// see package logglyotel for OpenTelemetry.
+	Trace func(context.Context) (traceID, spanID string, ok bool)
+
+	// Called with errors of background flushes, outside the lock.
+	// It must not block, but may call Close.
+	OnError func(error)
+
+	// Discard flushed messages without any request, counting them
+	// in Stats.MessagesDryRun. Writer still receives each message.
+	DryRun bool
+
+	// Called after each batch is delivered or given up on,
+	// outside the lock. It must not block.
+	OnFlush func(FlushResult)
+
+	// Name of the timestamp field ["timestamp"]
+	TimestampField string
+
+	// Name of the field holding the text of level helper, slog
+	// and WriteMessage messages ["message"]
+	MessageField string
+
+	// Format of added timestamps and time.Time values [TimestampMillis]
+	TimestampFormat TimestampFormat
+
+	// Format of time.Duration values [DurationString]
+	DurationFormat DurationFormat
+
+	// Convert string values holding a JSON number, such as "200",
+	// to numbers so fields keep a single type in loggly.
+	CoerceNumbers bool
+
+	// Fields converted by CoerceNumbers, all when empty. Numbers with
+	// leading zeros such as zip codes are never converted.
+	NumericFields []string
+
+	// Flatten nested messages and maps into dotted keys,
+	// for example "req.method". Slices are left intact.
+	Flatten bool
+
+	// Marshals messages, defaulting to json.Marshal.
+	Marshal func(interface{}) ([]byte, error)
+
+	// Keys whose values are redacted, case-insensitive.
+	RedactKeys []string
+
+	// Rewrite keys loggly does not index, replacing characters other
+	// than letters, digits, "_" and "-" with "_" and prefixing leading
+	// digits with "_". Colliding keys are suffixed with "_2", "_3"...
+	SanitizeKeys bool
+
+	// Run in order on each message after defaults are merged,
+	// returning the message to send, or false to drop it.
+	Hooks []func(Message) (Message, bool)
+
+	// Keys messages must have once defaults are merged and hooks
+	// have run, others are rejected with ErrMissingField.
+	RequiredFields []string
+
+	// Default properties. Mutating it once logging has started
+	// is unsafe, use SetDefault or SetDefaults instead.
 	Defaults Message
-	buffer   [][]byte
+	buffer   []*entry
+	seen     map[uint64]*entry
+	size     int
 	tags     []string
+	writers  []io.Writer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closed   bool
+	space    *sync.Cond
+	flushing chan struct{}
+	wake     chan struct{}
+	paused   time.Time
+	reported uint64
+	inflight sync.WaitGroup
+	response *http.Response
+	ticker   *time.Ticker
+	rng      *rand.Rand
+	rngMu    sync.Mutex
+	limiter  bucket
+	client   *http.Client
+	once     sync.Once
+	ready    sync.Once
+	breaker  breaker
+	stats    counters
+	root     *Client
+	fields   Message
+	invalid  error
 	sync.Mutex
 }
 
 // New returns a new loggly client with the given `token`.
 // Optionally pass `tags` or set them later with `.Tag()`.
 func New(token string, tags ...string) *Client {
+	return NewWithOptions(token, WithTags(tags...))
+}
+
+// NewWithRegion returns a new loggly client with the given `token`
+// sending to `region`, either "us" or "eu".
+func NewWithRegion(token, region string, tags ...string) (*Client, error) {
+	c, err := newClient(token, region, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.start()
+
+	return c, nil
+}
+
+// NewClient returns a new loggly client with the given `token`,
+// or an error when the token or end-point are invalid.
+func NewClient(token string, tags ...string) (*Client, error) {
+	c, err := newClient(token, "us", tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	go c.start()
+
+	return c, nil
+}
+
+// NewFromEnv returns a new loggly client configured by LOGGLY_TOKEN,
+// LOGGLY_TAGS (comma-separated), LOGGLY_LEVEL (such as "warning"),
+// LOGGLY_REGION, LOGGLY_FLUSH_INTERVAL (such as "10s") and
+// LOGGLY_HOSTNAME, replacing the "hostname" default or removing it
+// when set but empty. Only the token is required, invalid values
+// are reported as errors.
+func NewFromEnv() (*Client, error) {
+	token := os.Getenv("LOGGLY_TOKEN")
+	if token == "" {
+		return nil, ErrNoToken
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(os.Getenv("LOGGLY_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	c, err := newClient(token, os.Getenv("LOGGLY_REGION"), tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if host, ok := os.LookupEnv("LOGGLY_HOSTNAME"); ok {
+		if host != "" {
+			c.Defaults["hostname"] = host
+		} else {
+			delete(c.Defaults, "hostname")
+		}
+	}
+
+	if v := os.Getenv("LOGGLY_LEVEL"); v != "" {
+		level, err := ParseLevel(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("loggly: invalid LOGGLY_LEVEL %q", v)
+		}
+		c.Level = level
+	}
+
+	if v := os.Getenv("LOGGLY_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("loggly: invalid LOGGLY_FLUSH_INTERVAL %q", v)
+		}
+		c.FlushInterval = d
+	}
+
+	go c.start()
+
+	return c, nil
+}
+
+// Return a new client without starting the flusher.
+func newClient(token, region string, tags []string) (*Client, error) {
+	region = strings.ToLower(region)
+	if region == "" {
+		region = "us"
+	}
+
+	endpoint, err := endpointFor(region, "bulk", token)
+	if err != nil {
+		return nil, err
+	}
+
 	host, err := os.Hostname()
 	defaults := Message{}
 
@@ -74,150 +617,2544 @@ func New(token string, tags ...string) *Client {
 		BufferSize:    100,
 		FlushInterval: 5 * time.Second,
 		Token:         token,
-		Endpoint:      strings.Replace(api, "{token}", token, 1),
-		buffer:        make([][]byte, 0),
+		Region:        region,
+		Endpoint:      endpoint,
+		MaxRetries:    3,
+		RetryBackoff:  500 * time.Millisecond,
+		Jitter:        true,
+		buffer:        make([]*entry, 0),
 		Defaults:      defaults,
 	}
 
+	c.setup()
 	c.Tag(tags...)
 
-	go c.start()
-
-	return c
+	return c, nil
 }
 
-// Send buffers `msg` for async sending.
-func (c *Client) Send(msg Message) error {
-	if _, exists := msg["timestamp"]; !exists {
-		msg["timestamp"] = time.Now().UnixNano() / int64(time.Millisecond)
-	}
-	Merge(msg, c.Defaults)
+// Create the internal state of the client, once, so that clients
+// declared as a Client literal rather than by a constructor work.
+func (c *Client) setup() {
+	c.ready.Do(func() {
+		c.flushing = make(chan struct{}, 1)
+		c.wake = make(chan struct{}, 1)
+		c.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		c.space = sync.NewCond(&c.Mutex)
+	})
+}
 
-	json, err := Marshal(msg)
-	if err != nil {
-		return err
+// Validate checks the token, end-point, method and content type.
+func (c *Client) Validate() error {
+	if c.root != nil {
+		return c.root.Validate()
 	}
 
 	c.Lock()
-	defer c.Unlock()
+	token := c.Token
+	c.Unlock()
 
-	if c.Writer != nil {
-		fmt.Fprintf(c.Writer, "%s\n", string(json))
+	if token == "" {
+		return ErrNoToken
 	}
 
-	c.buffer = append(c.buffer, json)
+	if c.invalid != nil {
+		return c.invalid
+	}
 
-	debug("buffer (%d/%d) %v", len(c.buffer), c.BufferSize, msg)
+	endpoint, err := c.endpoint("bulk", "")
+	if err != nil {
+		return err
+	}
 
-	if len(c.buffer) >= c.BufferSize {
-		go c.Flush()
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("loggly: invalid end-point %q", endpoint)
 	}
 
-	return nil
+	_, _, err = c.request()
+	return err
 }
 
-// Write raw data to loggly.
-func (c *Client) Write(b []byte) (int, error) {
-	c.Lock()
-	defer c.Unlock()
+// Return the method and content type of bulk requests, checking
+// the method sends a body and the content type parses.
+func (c *Client) request() (method, contentType string, err error) {
+	method, contentType = c.Method, c.ContentType
 
-	if c.Writer != nil {
-		fmt.Fprintf(c.Writer, "%s", b)
+	switch method {
+	case "":
+		method = http.MethodPost
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return "", "", fmt.Errorf("%w: method %q", ErrInvalidRequest, method)
 	}
 
-	c.buffer = append(c.buffer, b)
-
-	debug("buffer (%d/%d) %q", len(c.buffer), c.BufferSize, b)
-
-	if len(c.buffer) >= c.BufferSize {
-		go c.Flush()
+	if contentType == "" {
+		if c.Format == FormatJSONArray {
+			contentType = "application/json"
+		} else {
+			contentType = "text/plain"
+		}
+	} else if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return "", "", fmt.Errorf("%w: content type %q", ErrInvalidRequest, contentType)
 	}
 
-	return len(b), nil
+	return method, contentType, nil
 }
 
-// Flush the buffered messages.
-func (c *Client) Flush() error {
-	c.Lock()
+// Ping sends an empty bulk request and returns the HTTP status,
+// verifying the end-point and token. Returns 0 with DryRun.
+func (c *Client) Ping() (int, error) {
+	if c.root != nil {
+		return c.root.Ping()
+	}
 
-	if len(c.buffer) == 0 {
-		debug("no messages to flush")
-		c.Unlock()
-		return nil
+	if c.DryRun {
+		return 0, nil
 	}
 
-	debug("flushing %d messages", len(c.buffer))
-	body := bytes.Join(c.buffer, nl)
+	tags := c.tagsList()
+	endpoint, err := c.endpoint("bulk", tags)
+	if err != nil {
+		return 0, err
+	}
 
-	c.buffer = nil
-	c.Unlock()
+	res, err := c.post(context.Background(), endpoint, tags, nil, false)
+	return statusOf(res), err
+}
 
-	client := &http.Client{}
-	debug("POST %s with %d bytes", c.Endpoint, len(body))
-	req, err := http.NewRequest("POST", c.Endpoint, bytes.NewBuffer(body))
-	if err != nil {
-		debug("error: %v", err)
-		return err
+// HealthCheck sends an empty bulk request, adding no events, and returns
+// an error unless loggly answers with a 2xx status before `ctx` is done.
+// Meant for readiness probes. Always succeeds with DryRun.
+func (c *Client) HealthCheck(ctx context.Context) error {
+	if c.root != nil {
+		return c.root.HealthCheck(ctx)
 	}
 
-	req.Header.Add("User-Agent", "go-loggly (version: "+Version+")")
-	req.Header.Add("Content-Type", "text/plain")
-	req.Header.Add("Content-Length", string(len(body)))
+	if c.DryRun {
+		return nil
+	}
 
 	tags := c.tagsList()
-	if tags != "" {
-		req.Header.Add("X-Loggly-Tag", tags)
+	endpoint, err := c.endpoint("bulk", tags)
+	if err != nil {
+		return err
 	}
 
-	res, err := client.Do(req)
+	res, err := c.post(ctx, endpoint, tags, nil, false)
 	if err != nil {
-		debug("error: %v", err)
 		return err
 	}
 
-	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return &FlushError{StatusCode: res.StatusCode, Body: string(body)}
+	}
 
-	debug("%d response", res.StatusCode)
-	if res.StatusCode >= 400 {
-		resp, _ := ioutil.ReadAll(res.Body)
-		debug("error: %s", string(resp))
+	return nil
+}
+
+// Return the end-point for `region`, `path` ("bulk" or "inputs") and `token`.
+func endpointFor(region, path, token string) (string, error) {
+	host, ok := hosts[strings.ToLower(region)]
+	if !ok {
+		return "", fmt.Errorf("loggly: unknown region %q", region)
 	}
 
-	return err
+	return buildEndpoint("https://"+host, path, token), nil
 }
 
-// Tag adds the given `tags` for all logs.
-func (c *Client) Tag(tags ...string) {
+// Return the end-point for `path` ("bulk" or "inputs") and `token` under `base`.
+func buildEndpoint(base, path, token string) string {
+	return strings.TrimRight(base, "/") + "/" + path + "/" + token
+}
+
+// Return the client's end-point for `path`, "bulk" or "inputs",
+// with the comma-delimited `tags` appended per TagMode.
+func (c *Client) endpoint(path, tags string) (string, error) {
+	var endpoint string
+	var err error
+
 	c.Lock()
-	defer c.Unlock()
+	token, bulk := c.Token, c.Endpoint
+	c.Unlock()
 
-	for _, tag := range tags {
-		c.tags = append(c.tags, tag)
+	switch {
+	case c.BaseURL != "":
+		endpoint = buildEndpoint(c.BaseURL, path, token)
+	case path == "bulk":
+		endpoint = bulk
+	default:
+		endpoint, err = endpointFor(c.Region, path, token)
+	}
+
+	if err != nil || c.TagMode != TagModePath || tags == "" {
+		return endpoint, err
 	}
+
+	segments := strings.Split(tags, ",")
+	for i, tag := range segments {
+		segments[i] = url.PathEscape(tag)
+	}
+
+	return strings.TrimRight(endpoint, "/") + "/tag/" + strings.Join(segments, ",") + "/", nil
 }
 
-// Return a comma-delimited tag list string.
-func (c *Client) tagsList() string {
-	c.Lock()
-	defer c.Unlock()
+// Send buffers `msg` for async sending. The level is read
+// from the message's "level" key, defaulting to INFO. A nil
+// `msg` is sent as the defaults and timestamp alone.
+func (c *Client) Send(msg Message) error {
+	return c.SendLevel(levelOf(msg), msg)
+}
 
-	return strings.Join(c.tags, ",")
+// SendLevel buffers `msg` for async sending unless `level`
+// is below the client's level.
+func (c *Client) SendLevel(level Level, msg Message) error {
+	return c.base().send(level, msg, nil, c.fields)
 }
 
-// Start flusher.
-func (c *Client) start() {
-	for {
-		time.Sleep(c.FlushInterval)
-		debug("interval %v reached", c.FlushInterval)
-		c.Flush()
+// SendTagged buffers `msg` like Send with additional `tags`. As tags
+// apply to a whole bulk request, messages are sent in a separate
+// request per set of tags, which may reorder messages across sets.
+func (c *Client) SendTagged(msg Message, tags ...string) error {
+	tags, err := c.base().checkTags(tags)
+	if err != nil {
+		return err
 	}
+
+	return c.base().send(levelOf(msg), msg, tags, c.fields)
 }
 
-// Merge others into a.
-func Merge(a Message, others ...Message) {
-	for _, msg := range others {
-		for k, v := range msg {
-			a[k] = v
-		}
+// Buffer `msg` at `level` with per-message `tags`, layering
+// `fields` over the defaults.
+func (c *Client) send(level Level, msg Message, tags []string, fields Message) error {
+	if !c.keep(level) {
+		return nil
+	}
+
+	e, err := c.prepare(msg, tags, fields)
+	if err != nil || e == nil {
+		return err
 	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		c.stats.messagesDropped.Add(1)
+		return ErrClosed
+	}
+
+	c.mirrorEntry(e)
+
+	debug("buffer (%d/%d) %s", len(c.buffer)+1, c.BufferSize, e.data)
+
+	err = c.enqueue(e)
+	c.trigger()
+	return err
+}
+
+// SendBatch buffers `msgs` under a single lock, keeping them contiguous,
+// and returns how many were buffered along with the first marshal error.
+// Levels are read as in Send.
+func (c *Client) SendBatch(msgs []Message) (int, error) {
+	return c.base().sendBatch(msgs, c.fields)
+}
+
+// Buffer `msgs` under a single lock, layering `fields` over the defaults.
+func (c *Client) sendBatch(msgs []Message, fields Message) (int, error) {
+	var first error
+	var batch []*entry
+
+	for _, msg := range msgs {
+		if !c.keep(levelOf(msg)) {
+			continue
+		}
+
+		e, err := c.prepare(msg, nil, fields)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		if e == nil {
+			continue
+		}
+
+		batch = append(batch, e)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		c.stats.messagesDropped.Add(uint64(len(batch)))
+		return 0, ErrClosed
+	}
+
+	n := 0
+	for _, e := range batch {
+		c.mirrorEntry(e)
+
+		if err := c.enqueue(e); err != nil {
+			c.stats.messagesDropped.Add(uint64(len(batch) - n - 1))
+			return n, err
+		}
+		n++
+	}
+
+	debug("buffer (%d/%d) batch of %d", len(c.buffer), c.BufferSize, n)
+
+	c.trigger()
+	return n, first
+}
+
+// Decide whether to keep a message at `level` per
+// the client's level, sampling and rate limit.
+func (c *Client) keep(level Level) bool {
+	if level < c.Level {
+		debug("dropping message below level (%d < %d)", level, c.Level)
+		return false
+	}
+
+	if !c.sample(level) {
+		debug("sampled out message at level %s", level)
+		c.stats.sampledOut.Add(1)
+		return false
+	}
+
+	if !c.allow(level) {
+		debug("rate limited message at level %s", level)
+		c.stats.rateLimited.Add(1)
+		return false
+	}
+
+	return true
+}
+
+// Marshal `msg` into a buffer entry with `tags`,
+// nil when dropped by a hook.
+func (c *Client) prepare(msg Message, tags []string, fields Message) (*entry, error) {
+	msg, json, err := c.marshal(msg, fields)
+	if err != nil || json == nil {
+		return nil, err
+	}
+
+	e := &entry{data: json, tags: tags, count: 1}
+	if c.Dedup {
+		e.key = c.dedupKey(msg, tags)
+	}
+
+	if c.WriterFunc != nil {
+		e.out = c.WriterFunc(msg)
+	}
+
+	return e, nil
+}
+
+// SendNow sends `msg` synchronously to the single-event
+// inputs end-point, bypassing the buffer.
+func (c *Client) SendNow(msg Message) error {
+	return c.base().sendNow(msg, c.fields)
+}
+
+// Send `msg` to the inputs end-point, layering `fields` over the defaults.
+func (c *Client) sendNow(msg Message, fields Message) error {
+	if level := levelOf(msg); level < c.Level {
+		debug("dropping message below level (%d < %d)", level, c.Level)
+		return nil
+	}
+
+	msg, json, err := c.marshal(msg, fields)
+	if err != nil || json == nil {
+		return err
+	}
+
+	e := &entry{data: json, count: 1}
+	if c.WriterFunc != nil {
+		e.out = c.WriterFunc(msg)
+	}
+
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrClosed
+	}
+	c.mirrorEntry(e)
+	c.Unlock()
+
+	if c.DryRun {
+		debug("dry run, discarding %s", json)
+		c.stats.dryRun.Add(1)
+		return nil
+	}
+
+	tags := c.tagsList()
+	endpoint, err := c.endpoint("inputs", tags)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.post(context.Background(), endpoint, tags, json, false); err != nil {
+		c.stats.flushErrors.Add(1)
+		return err
+	}
+
+	c.stats.messagesSent.Add(1)
+	c.stats.bytesSent.Add(uint64(len(json)))
+	return nil
+}
+
+// Merge defaults, `fields`, source and version into `msg`, run hooks, check
+// required fields, add its timestamp, normalize values, redact, flatten
+// and marshal it, returning the message sent. Returns nil when a hook
+// drops the message.
+func (c *Client) marshal(msg Message, fields Message) (Message, []byte, error) {
+	c.Lock()
+	msg = MergedCopy(msg, c.Defaults, fields)
+	c.Unlock()
+
+	if _, exists := msg["source"]; !exists && c.Source != "" {
+		msg["source"] = c.Source
+	}
+
+	if _, exists := msg["source_category"]; !exists && c.SourceCategory != "" {
+		msg["source_category"] = c.SourceCategory
+	}
+
+	if c.IncludeClientVersion {
+		msg["_loggly_client_version"] = Version
+	}
+
+	for _, hook := range c.Hooks {
+		var keep bool
+		if msg, keep = hook(msg); !keep || msg == nil {
+			debug("message dropped by hook")
+			return nil, nil, nil
+		}
+	}
+
+	for _, key := range c.RequiredFields {
+		if _, exists := msg[key]; !exists {
+			return nil, nil, fmt.Errorf("%w %q", ErrMissingField, key)
+		}
+	}
+
+	if _, exists := msg[c.timestampField()]; !exists {
+		msg[c.timestampField()] = c.timestamp(time.Now())
+	}
+
+	msg = walkMessage(msg, c.normalize)
+
+	if c.CoerceNumbers {
+		msg = walkMessage(msg, c.coerce)
+	}
+
+	if len(c.RedactKeys) > 0 {
+		msg = redact(msg, c.RedactKeys)
+	}
+
+	if c.SanitizeKeys {
+		msg = sanitize(msg)
+	}
+
+	if c.Flatten {
+		msg = flatten(msg)
+	}
+
+	json, err := c.encode(msg)
+	if err != nil {
+		debug("error: %v, degrading message", err)
+		msg = c.degrade(msg, err)
+
+		json, err = c.encode(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if c.MaxEventBytes > 0 && len(json) > c.MaxEventBytes {
+		debug("truncating %d byte event to %d", len(json), c.MaxEventBytes)
+		json, err = c.truncate(msg, json)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return msg, json, nil
+}
+
+// Return a copy of `msg` with values failing to marshal formatted
+// with %v and a "_marshal_error" marker describing `err`.
+func (c *Client) degrade(msg Message, err error) Message {
+	d := make(Message, len(msg)+1)
+
+	for k, v := range msg {
+		if _, err := c.encode(v); err != nil {
+			v = fmt.Sprintf("%v", v)
+		}
+		d[k] = v
+	}
+
+	d["_marshal_error"] = err.Error()
+	return d
+}
+
+// Marshal `v` with the client's marshaler, trimming the
+// trailing newline added by json.Encoder based marshalers.
+func (c *Client) encode(v interface{}) ([]byte, error) {
+	if c.Marshal != nil {
+		b, err := c.Marshal(v)
+		return bytes.TrimSuffix(b, nl), err
+	}
+
+	return Marshal(v)
+}
+
+// Return the name of the timestamp field.
+func (c *Client) timestampField() string {
+	if c.TimestampField == "" {
+		return "timestamp"
+	}
+
+	return c.TimestampField
+}
+
+// Return the name of the message text field.
+func (c *Client) messageField() string {
+	if c.MessageField == "" {
+		return "message"
+	}
+
+	return c.MessageField
+}
+
+// MessageKey returns the name of the message text field,
+// that of the root client for children of With.
+func (c *Client) MessageKey() string {
+	return c.base().messageField()
+}
+
+// TimestampKey returns the name of the timestamp field,
+// that of the root client for children of With.
+func (c *Client) TimestampKey() string {
+	return c.base().timestampField()
+}
+
+// Format `t` per TimestampFormat.
+func (c *Client) timestamp(t time.Time) interface{} {
+	switch c.TimestampFormat {
+	case TimestampSeconds:
+		return t.Unix()
+	case TimestampRFC3339:
+		return t.Format(time.RFC3339Nano)
+	default:
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+// Return the dedup key of `msg` and `tags`, ignoring its timestamp.
+func (c *Client) dedupKey(msg Message, tags []string) uint64 {
+	msg = MergedCopy(msg)
+	delete(msg, c.timestampField())
+
+	b, _ := Marshal(msg)
+	h := fnv.New64a()
+	h.Write(b)
+	h.Write([]byte(strings.Join(tags, ",")))
+	return h.Sum64()
+}
+
+// SendContext buffers `msg` like Send, adding the "trace_id" and
+// "span_id" of the span in `ctx` when Trace is set.
+func (c *Client) SendContext(ctx context.Context, msg Message) error {
+	if trace := c.base().Trace; trace != nil {
+		if traceID, spanID, ok := trace(ctx); ok {
+			msg = MergedCopy(msg, Message{"trace_id": traceID, "span_id": spanID})
+		}
+	}
+
+	return c.Send(msg)
+}
+
+// SendSync buffers `msg` and flushes synchronously,
+// returning any delivery error.
+func (c *Client) SendSync(msg Message) error {
+	if err := c.Send(msg); err != nil {
+		return err
+	}
+
+	return c.Flush()
+}
+
+// SendWithTimeout buffers `msg` and flushes synchronously like SendSync,
+// returning context.DeadlineExceeded when delivery takes longer than `d`.
+// The messages of a timed out flush are returned to the buffer for the
+// next flush, though loggly may already have received them.
+func (c *Client) SendWithTimeout(msg Message, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	if err := c.Send(msg); err != nil {
+		return err
+	}
+
+	if err := c.FlushContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Debug sends `event` at DEBUG level with optional `props`.
+func (c *Client) Debug(event string, props Message) error {
+	return c.log(DEBUG, event, props)
+}
+
+// Info sends `event` at INFO level with optional `props`.
+func (c *Client) Info(event string, props Message) error {
+	return c.log(INFO, event, props)
+}
+
+// Warning sends `event` at WARNING level with optional `props`.
+func (c *Client) Warning(event string, props Message) error {
+	return c.log(WARNING, event, props)
+}
+
+// Error sends `event` at ERROR level with optional `props`.
+func (c *Client) Error(event string, props Message) error {
+	return c.log(ERROR, event, props)
+}
+
+// Fatal sends `event` at FATAL level with optional `props`
+// and flushes synchronously.
+func (c *Client) Fatal(event string, props Message) error {
+	if err := c.log(FATAL, event, props); err != nil {
+		return err
+	}
+
+	return c.Flush()
+}
+
+// Decide whether to keep a message at `level` per SampleRate.
+func (c *Client) sample(level Level) bool {
+	rate, ok := c.SampleRate[level]
+	if !ok || rate >= 1 || level == FATAL {
+		return true
+	}
+
+	c.setup()
+	c.rngMu.Lock()
+	defer c.rngMu.Unlock()
+
+	return c.rng.Float64() < rate
+}
+
+// Return a random duration in [0, d).
+func (c *Client) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+
+	c.setup()
+	c.rngMu.Lock()
+	defer c.rngMu.Unlock()
+
+	return time.Duration(c.rng.Int63n(int64(d)))
+}
+
+// Send `event` at `level`, merging `props`. Must be
+// called directly by the level helpers for IncludeCaller.
+func (c *Client) log(level Level, event string, props Message) error {
+	r := c.base()
+	if level < r.Level {
+		return nil
+	}
+
+	msg := Message{}
+	Merge(msg, props)
+	msg["level"] = level.String()
+	msg[r.messageField()] = event
+
+	if r.IncludeCaller {
+		if _, file, line, ok := runtime.Caller(2); ok {
+			msg["file"] = file
+			msg["line"] = line
+		}
+	}
+
+	if r.CaptureStack && level >= ERROR {
+		buf := make([]byte, 64<<10)
+		msg["stack"] = string(buf[:runtime.Stack(buf, false)])
+	}
+
+	return r.send(level, msg, nil, c.fields)
+}
+
+// Write raw data to loggly. With ParseLevelPrefix, data starting
+// with a level such as "[ERROR]" is filtered as with WriteLevel.
+func (c *Client) Write(b []byte) (int, error) {
+	if c.root != nil {
+		return c.root.Write(b)
+	}
+
+	if c.ParseLevelPrefix {
+		if level, ok := levelPrefix(b); ok {
+			return c.WriteLevel(level, b)
+		}
+	}
+
+	return c.write(b)
+}
+
+// WriteLevel writes raw data to loggly unless `level`
+// is below the client's level.
+func (c *Client) WriteLevel(level Level, b []byte) (int, error) {
+	if c.root != nil {
+		return c.root.WriteLevel(level, b)
+	}
+
+	if !c.keep(level) {
+		return len(b), nil
+	}
+
+	return c.write(b)
+}
+
+// Return the level of data starting with "[LEVEL]".
+func levelPrefix(b []byte) (Level, bool) {
+	b = bytes.TrimLeft(b, " ")
+	if len(b) == 0 || b[0] != '[' {
+		return 0, false
+	}
+
+	end := bytes.IndexByte(b, ']')
+	if end < 0 {
+		return 0, false
+	}
+
+	level, ok := levels[strings.ToLower(string(b[1:end]))]
+	return level, ok
+}
+
+// Buffer raw data.
+func (c *Client) write(b []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		c.stats.messagesDropped.Add(1)
+		return 0, ErrClosed
+	}
+
+	c.mirror("%s", b)
+
+	debug("buffer (%d/%d) %q", len(c.buffer)+1, c.BufferSize, b)
+
+	err := c.enqueue(&entry{data: append([]byte(nil), b...), count: 1})
+	c.trigger()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteMessage sends the JSON object `b` as a message like Send, merging
+// defaults and adding a timestamp, unlike Write. Data other than a JSON
+// object is sent as the MessageField of a new message. Numbers are kept
+// as written.
+func (c *Client) WriteMessage(b []byte) error {
+	// large integers would lose precision as float64
+	dec := NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var msg Message
+	if err := dec.Decode(&msg); err != nil || msg == nil || dec.Decode(new(RawMessage)) != io.EOF {
+		msg = Message{c.base().messageField(): string(bytes.TrimRight(b, "\r\n"))}
+	}
+
+	return c.Send(msg)
+}
+
+// StdLogger returns a *log.Logger writing each entry as a raw event.
+func (c *Client) StdLogger(prefix string, flag int) *log.Logger {
+	return log.New(lineWriter{c}, prefix, flag)
+}
+
+// Writer stripping the trailing newline added by log.Logger.
+type lineWriter struct {
+	client *Client
+}
+
+// Write implements io.Writer.
+func (w lineWriter) Write(b []byte) (int, error) {
+	if _, err := w.client.Write(bytes.TrimSuffix(b, nl)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// AddWriter adds `w` to the writers receiving a copy of the output.
+func (c *Client) AddWriter(w io.Writer) {
+	if c.root != nil {
+		c.root.AddWriter(w)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.writers = append(c.writers, w)
+}
+
+// RemoveWriter removes `w` from the writers added with AddWriter.
+func (c *Client) RemoveWriter(w io.Writer) {
+	if c.root != nil {
+		c.root.RemoveWriter(w)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for i, v := range c.writers {
+		if v == w {
+			c.writers = append(c.writers[:i:i], c.writers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Output `b` to the writers. Must be called with the lock held.
+func (c *Client) mirror(format string, b []byte) {
+	if c.Writer != nil {
+		fmt.Fprintf(c.Writer, format, b)
+	}
+
+	for _, w := range c.writers {
+		fmt.Fprintf(w, format, b)
+	}
+}
+
+// Write `e` to the writers, formatted by WriterFunc when set.
+// Must be called with the lock held.
+func (c *Client) mirrorEntry(e *entry) {
+	if e.out != nil {
+		c.mirror("%s\n", e.out)
+		e.out = nil
+		return
+	}
+
+	c.mirror("%s\n", e.data)
+}
+
+// Append `e` to the buffer applying the drop policy.
+// Must be called with the lock held.
+func (c *Client) enqueue(e *entry) error {
+	if prev, ok := c.seen[e.key]; ok && e.key != 0 {
+		prev.count++
+		return nil
+	}
+
+	if c.MaxMemoryBytes > 0 && len(e.data) > c.MaxMemoryBytes {
+		debug("message of %d bytes exceeds MaxMemoryBytes, dropping", len(e.data))
+		c.stats.messagesDropped.Add(1)
+		return nil
+	}
+
+	for c.full(len(e.data)) {
+		switch c.DropPolicy {
+		case DropNewest:
+			debug("buffer full, dropping newest")
+			c.stats.messagesDropped.Add(1)
+			return nil
+		case Block:
+			debug("buffer full, blocking")
+			c.setup()
+			c.signal()
+			c.space.Wait()
+			if c.closed {
+				c.stats.messagesDropped.Add(1)
+				return ErrClosed
+			}
+		default:
+			debug("buffer full, dropping oldest")
+			c.stats.messagesDropped.Add(1)
+			c.size -= len(c.buffer[0].data)
+			c.forget(c.buffer[0])
+			c.buffer = c.buffer[1:]
+		}
+	}
+
+	if e.key != 0 {
+		if c.seen == nil {
+			c.seen = make(map[uint64]*entry)
+		}
+		c.seen[e.key] = e
+	}
+
+	c.buffer = append(c.buffer, e)
+	c.size += len(e.data)
+	c.gauge()
+
+	return nil
+}
+
+// Check if the buffer has no room for `n` more bytes
+// per MaxBufferSize and MaxMemoryBytes.
+func (c *Client) full(n int) bool {
+	if c.MaxBufferSize > 0 && len(c.buffer) >= c.MaxBufferSize {
+		return true
+	}
+
+	return c.MaxMemoryBytes > 0 && c.size+n > c.MaxMemoryBytes
+}
+
+// Check if the buffer exceeds MaxBufferSize or MaxMemoryBytes.
+func (c *Client) overflowing() bool {
+	if c.MaxBufferSize > 0 && len(c.buffer) > c.MaxBufferSize {
+		return true
+	}
+
+	return c.MaxMemoryBytes > 0 && c.size > c.MaxMemoryBytes
+}
+
+// Flush in the background when the buffer reaches BufferSize
+// or FlushBytes. Must be called with the lock held.
+func (c *Client) trigger() {
+	if c.closed {
+		return
+	}
+
+	if len(c.buffer) >= c.BufferSize || (c.FlushBytes > 0 && c.size >= c.FlushBytes) {
+		c.signal()
+	}
+}
+
+// Remove `e` from the dedup window. Must be called with the lock held.
+func (c *Client) forget(e *entry) {
+	if c.seen[e.key] == e {
+		delete(c.seen, e.key)
+	}
+}
+
+// Flush the buffered messages.
+func (c *Client) Flush() error {
+	_, err := c.FlushN()
+	return err
+}
+
+// FlushN flushes the buffered messages, returning how many
+// were delivered, which may be partial when MaxBatchSize splits
+// the buffer into several requests, and the first error.
+func (c *Client) FlushN() (int, error) {
+	if c.root != nil {
+		return c.root.FlushN()
+	}
+
+	return c.flushWait(context.Background())
+}
+
+// FlushResponse flushes the buffered messages like Flush, returning the
+// last response received, nil when there was nothing to send or no
+// response. Its body has already been read and closed, and is replayed
+// from memory. Meant for diagnostics, such as checking loggly's reply.
+func (c *Client) FlushResponse() (*http.Response, error) {
+	if c.root != nil {
+		return c.root.FlushResponse()
+	}
+
+	c.setup()
+	c.flushing <- struct{}{}
+	defer func() { <-c.flushing }()
+
+	c.response = nil
+	_, err := c.flush(context.Background())
+	return c.response, err
+}
+
+// FlushContext flushes the buffered messages, aborting when `ctx`
+// is done. Messages of an aborted flush are returned to the buffer.
+// Waits for any flush already in progress.
+func (c *Client) FlushContext(ctx context.Context) error {
+	if c.root != nil {
+		return c.root.FlushContext(ctx)
+	}
+
+	_, err := c.flushWait(ctx)
+	return err
+}
+
+// Flush after waiting for any flush in progress.
+func (c *Client) flushWait(ctx context.Context) (int, error) {
+	c.setup()
+
+	select {
+	case c.flushing <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	defer func() { <-c.flushing }()
+
+	return c.flush(ctx)
+}
+
+// Flush within FlushTimeout, converting a panic into an error
+// wrapping ErrFlushPanic so the flusher keeps running.
+func (c *Client) recoverFlush() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			debug("recovered flush panic: %v", r)
+			err = fmt.Errorf("%w: %v", ErrFlushPanic, r)
+		}
+	}()
+
+	timeout := c.flushTimeout()
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+
+	_, err = c.flush(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded && c.ctx.Err() == nil {
+		debug("flush timed out after %v", timeout)
+		err = fmt.Errorf("loggly: flush timed out after %v: %w", timeout, err)
+	}
+
+	return err
+}
+
+// Return FlushTimeout, defaulting to the larger of FlushInterval and a minute.
+func (c *Client) flushTimeout() time.Duration {
+	if c.FlushTimeout > 0 {
+		return c.FlushTimeout
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.FlushInterval > time.Minute {
+		return c.FlushInterval
+	}
+
+	return time.Minute
+}
+
+// Wake the flusher. Pending signals are coalesced
+// into a single flush, so this never blocks.
+func (c *Client) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the number of buffered messages not yet sent.
+// Messages of a flush in progress are not counted.
+func (c *Client) Pending() int {
+	if c.root != nil {
+		return c.root.Pending()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.buffer)
+}
+
+// Dump writes the buffered messages to `w`, newline-delimited, without
+// removing them. They are copied under the lock and written after, so
+// a slow `w` does not hold up sends or flushes. Messages of a flush in
+// progress are not included.
+func (c *Client) Dump(w io.Writer) error {
+	if c.root != nil {
+		return c.root.Dump(w)
+	}
+
+	var buf bytes.Buffer
+
+	c.Lock()
+	for _, e := range c.buffer {
+		buf.Write(e.bytes())
+		buf.Write(nl)
+	}
+	c.Unlock()
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Wait blocks until in-flight background flushes complete.
+func (c *Client) Wait() {
+	if c.root != nil {
+		c.root.Wait()
+		return
+	}
+
+	c.inflight.Wait()
+}
+
+// Flush in the background unless a flush is already in progress,
+// returning the error to report to OnError, if any.
+func (c *Client) flushAsync() error {
+	select {
+	case c.flushing <- struct{}{}:
+	default:
+		debug("flush in progress, skipping")
+		return nil
+	}
+
+	c.Lock()
+	paused := time.Now().Before(c.paused)
+	c.Unlock()
+
+	if paused {
+		debug("flushing paused, skipping")
+		<-c.flushing
+		return nil
+	}
+
+	err := c.recoverFlush()
+	<-c.flushing
+
+	if err == ErrCircuitOpen {
+		debug("circuit open, skipping")
+		return nil
+	}
+
+	if err == c.ctx.Err() {
+		return nil
+	}
+
+	return err
+}
+
+// Flush the buffer, one flush at a time, in requests of at most
+// MaxBatchSize messages sharing the same per-message tags, returning
+// how many buffered messages were delivered and the first error. A
+// transient failure stops the flush, requeueing the chunks not yet
+// sent, while rejected chunks are dropped and the flush goes on.
+func (c *Client) flush(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if c.invalid != nil {
+		return 0, c.invalid
+	}
+
+	// keep messages buffered until the method or content type is fixed
+	if _, _, err := c.request(); err != nil {
+		return 0, err
+	}
+
+	if err := c.allowFlush(); err != nil {
+		return 0, err
+	}
+
+	if c.SpoolDir != "" {
+		if err := c.replay(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	summary := c.dropSummary()
+
+	c.Lock()
+
+	if summary != nil {
+		c.buffer = append(c.buffer, summary)
+		c.size += len(summary.data)
+	}
+
+	if len(c.buffer) == 0 {
+		debug("no messages to flush")
+		c.Unlock()
+		return 0, nil
+	}
+
+	debug("flushing %d messages", len(c.buffer))
+	batch := c.buffer
+
+	c.buffer = nil
+	c.seen = nil
+	c.size = 0
+	c.gauge()
+	c.space.Broadcast()
+	c.Unlock()
+
+	sent := 0
+	var first error
+
+	chunks := c.chunks(batch)
+	for i, chunk := range chunks {
+		n, err := c.flushChunk(ctx, chunk, chunks[i+1:])
+		sent += n
+		if err == nil {
+			continue
+		}
+
+		if first == nil {
+			first = err
+		}
+
+		if ctx.Err() != nil || retryable(err) {
+			break
+		}
+	}
+
+	return sent, first
+}
+
+// Split `batch` into requests, grouping messages by their tags merged
+// with the client's, as the tag header applies to a whole request, then
+// by MaxBatchSize. Groups
+// are ordered by their first message, keeping the order within each.
+func (c *Client) chunks(batch []*entry) [][]*entry {
+	var keys []string
+	groups := make(map[string][]*entry)
+
+	c.Lock()
+	tags := append([]string(nil), c.tags...)
+	c.Unlock()
+
+	for _, e := range batch {
+		key := tagKey(append(tags[:len(tags):len(tags)], e.tags...))
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], e)
+	}
+
+	var chunks [][]*entry
+	for _, key := range keys {
+		group := groups[key]
+		for len(group) > 0 {
+			n := len(group)
+			if c.MaxBatchSize > 0 && n > c.MaxBatchSize {
+				n = c.MaxBatchSize
+			}
+
+			chunks = append(chunks, group[:n:n])
+			group = group[n:]
+		}
+	}
+
+	return chunks
+}
+
+// Return a key identifying the set of `tags`.
+func tagKey(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	set := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if !contains(set, tag) {
+			set = append(set, tag)
+		}
+	}
+	sort.Strings(set)
+
+	return strings.Join(set, ",")
+}
+
+// Deliver `chunk` of a flush, followed by the `rest` of the chunks,
+// which are requeued behind `chunk` when delivery fails transiently.
+// Chunks rejected as too large are delivered in halves, down to
+// single messages which are dropped. Returns the messages delivered.
+func (c *Client) flushChunk(ctx context.Context, chunk []*entry, rest [][]*entry) (int, error) {
+	file := c.spool(chunk)
+
+	err := c.deliver(ctx, chunk)
+	if err == nil {
+		c.unspool(file)
+		return len(chunk), nil
+	}
+
+	if tooLarge(err) && len(chunk) > 1 && ctx.Err() == nil {
+		c.unspool(file)
+		return c.split(ctx, chunk, rest)
+	}
+
+	if len(rest) > 0 && (ctx.Err() != nil || retryable(err)) {
+		var remaining []*entry
+		for _, r := range rest {
+			remaining = append(remaining, r...)
+		}
+		c.requeue(remaining)
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		c.unspool(file)
+		c.requeue(chunk)
+	case retryAfter(err) > 0:
+		c.unspool(file)
+		c.requeue(chunk)
+		c.pause(retryAfter(err))
+	case file != "" && retryable(err):
+		debug("keeping spooled batch %s", file)
+	case c.PreserveOrder && retryable(err):
+		c.requeue(chunk)
+	default:
+		c.unspool(file)
+		c.stats.messagesDropped.Add(uint64(len(chunk)))
+	}
+
+	return 0, err
+}
+
+// Deliver the halves of `chunk`, followed by the `rest` of the chunks,
+// stopping as flush does on the first transient failure. Returns the
+// messages delivered.
+func (c *Client) split(ctx context.Context, chunk []*entry, rest [][]*entry) (int, error) {
+	debug("batch of %d messages too large, splitting", len(chunk))
+
+	half := len(chunk) / 2
+	halves := [][]*entry{chunk[:half], chunk[half:]}
+
+	sent := 0
+	var first error
+	for i, h := range halves {
+		after := append(append([][]*entry(nil), halves[i+1:]...), rest...)
+
+		n, err := c.flushChunk(ctx, h, after)
+		sent += n
+		if err == nil {
+			continue
+		}
+
+		if first == nil {
+			first = err
+		}
+
+		if ctx.Err() != nil || retryable(err) {
+			return sent, err
+		}
+	}
+
+	return sent, first
+}
+
+// Buffer a meta-event announcing the client started.
+func (c *Client) started() {
+	msg := Message{
+		"loggly_client": "started",
+		"version":       Version,
+		"level":         "info",
+	}
+
+	_, json, err := c.marshal(msg, nil)
+	if err != nil {
+		debug("error: %v", err)
+		return
+	}
+
+	if json == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.enqueue(&entry{data: json, count: 1}); err != nil {
+		debug("error: %v", err)
+	}
+}
+
+// Return a meta-event counting messages dropped since the last one,
+// or nil when none were.
+func (c *Client) dropSummary() *entry {
+	c.Lock()
+	dropped := c.stats.messagesDropped.Load()
+	n := dropped - c.reported
+	if dropped < c.reported {
+		n = 0
+	}
+	c.reported = dropped
+	c.Unlock()
+
+	if n == 0 {
+		return nil
+	}
+
+	msg := Message{
+		"loggly_client": "dropped",
+		"count":         n,
+		"level":         "warning",
+	}
+
+	_, json, err := c.marshal(msg, nil)
+	if err != nil {
+		debug("error: %v", err)
+		return nil
+	}
+
+	if json == nil {
+		return nil
+	}
+
+	debug("reporting %d dropped messages", n)
+	return &entry{data: json, count: 1}
+}
+
+// Pause background flushes for `d`.
+func (c *Client) pause(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	debug("pausing flushes for %v", d)
+	c.paused = time.Now().Add(d)
+}
+
+// Check if `err` rejected a batch as too large.
+func tooLarge(err error) bool {
+	if e, ok := err.(*FlushError); ok {
+		return e.StatusCode == http.StatusRequestEntityTooLarge
+	}
+
+	return false
+}
+
+// Return the Retry-After delay of `err`, if any.
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*FlushError); ok {
+		return e.RetryAfter
+	}
+
+	return 0
+}
+
+// Parse a Retry-After header of seconds or an HTTP-date.
+func parseRetryAfter(h string) time.Duration {
+	if secs, err := strconv.Atoi(h); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+// Deliver `batch`, retrying transient failures. A response with a
+// Retry-After delay is returned at once rather than waited for here,
+// the batch being requeued and flushes paused by flushChunk.
+func (c *Client) deliver(ctx context.Context, batch []*entry) error {
+	start := time.Now()
+	body := c.join(batch)
+	tags := c.batchTags(batch)
+
+	report := func(res *http.Response, attempts int, err error) error {
+		c.response = res
+
+		if c.OnFlush != nil {
+			c.OnFlush(FlushResult{
+				Messages:   len(batch),
+				Bytes:      len(body),
+				StatusCode: statusOf(res),
+				Attempts:   attempts,
+				Duration:   time.Since(start),
+				Response:   res,
+				Err:        err,
+			})
+		}
+		return err
+	}
+
+	if c.DryRun {
+		debug("dry run, discarding %d messages", len(batch))
+		c.stats.dryRun.Add(uint64(len(batch)))
+		return report(nil, 0, nil)
+	}
+
+	gzipped := false
+	if c.CompressionThreshold > 0 && len(body) > c.CompressionThreshold {
+		compressed, err := compress(body)
+		if err != nil {
+			return report(nil, 0, err)
+		}
+
+		debug("compressed %d bytes to %d", len(body), len(compressed))
+		body = compressed
+		gzipped = true
+	}
+
+	retries := c.MaxRetries
+	if c.probing() {
+		retries = 0
+	}
+
+	endpoint, err := c.endpoint("bulk", tags)
+	if err != nil {
+		return report(nil, 0, err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := c.post(ctx, endpoint, tags, body, gzipped)
+		if err != nil && ctx.Err() != nil {
+			return report(res, attempt+1, ctx.Err())
+		}
+
+		open := c.record(err)
+
+		if err == nil {
+			c.stats.messagesSent.Add(uint64(len(batch)))
+			c.stats.batchesSent.Add(1)
+			c.stats.bytesSent.Add(uint64(len(body)))
+			return report(res, attempt+1, nil)
+		}
+
+		c.stats.flushErrors.Add(1)
+
+		if !retryable(err) || attempt >= retries || open || retryAfter(err) > 0 {
+			return report(res, attempt+1, err)
+		}
+
+		backoff := c.RetryBackoff << uint(attempt)
+		if c.Jitter {
+			backoff = c.jitter(backoff)
+		}
+
+		debug("retrying in %v", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return report(res, attempt+1, ctx.Err())
+		}
+	}
+}
+
+// Join `batch` into a request body.
+func (c *Client) join(batch []*entry) []byte {
+	lines := make([][]byte, len(batch))
+	for i, e := range batch {
+		lines[i] = e.bytes()
+	}
+
+	if c.Format != FormatJSONArray {
+		return bytes.Join(lines, nl)
+	}
+
+	body := []byte{'['}
+	body = append(body, bytes.Join(lines, []byte{','})...)
+	return append(body, ']')
+}
+
+// Return the entry's data, with a "_count" field when deduplicated,
+// reserved so as not to collide with a "count" of the message.
+func (e *entry) bytes() []byte {
+	if e.count < 2 || len(e.data) < 2 || e.data[0] != '{' {
+		return e.data
+	}
+
+	b := []byte(fmt.Sprintf(`{"_count":%d`, e.count))
+	if len(e.data) > 2 {
+		b = append(b, ',')
+	}
+
+	return append(b, e.data[1:]...)
+}
+
+// Return `batch` to the front of the buffer, ahead of messages
+// buffered since it was taken. A new slice is allocated as `batch`
+// may share its backing array with slices still referenced.
+func (c *Client) requeue(batch []*entry) {
+	c.Lock()
+	defer c.Unlock()
+
+	debug("requeueing %d messages", len(batch))
+	buffer := make([]*entry, 0, len(batch)+len(c.buffer))
+	buffer = append(buffer, batch...)
+	c.buffer = append(buffer, c.buffer...)
+
+	for _, e := range batch {
+		if _, ok := c.seen[e.key]; !ok && e.key != 0 {
+			if c.seen == nil {
+				c.seen = make(map[uint64]*entry)
+			}
+			c.seen[e.key] = e
+		}
+	}
+
+	c.size = size(c.buffer)
+
+	dropped := 0
+	for len(c.buffer) > 0 && c.overflowing() {
+		var e *entry
+		if c.DropPolicy == DropNewest {
+			e = c.buffer[len(c.buffer)-1]
+			c.buffer = c.buffer[:len(c.buffer)-1]
+		} else {
+			e = c.buffer[0]
+			c.buffer = c.buffer[1:]
+		}
+
+		c.size -= len(e.data)
+		c.forget(e)
+		dropped++
+	}
+
+	if dropped > 0 {
+		debug("buffer full, dropped %d messages", dropped)
+		c.stats.messagesDropped.Add(uint64(dropped))
+	}
+
+	c.gauge()
+}
+
+// Return the total bytes of `batch`.
+func size(batch []*entry) int {
+	n := 0
+	for _, e := range batch {
+		n += len(e.data)
+	}
+
+	return n
+}
+
+// Return HTTPClient or the default client.
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+
+	c.once.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyFromEnvironment
+
+		if c.Proxy != nil {
+			transport.Proxy = c.Proxy
+		}
+
+		if c.TLSConfig != nil {
+			transport.TLSClientConfig = c.TLSConfig.Clone()
+		}
+
+		c.client = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	})
+
+	return c.client
+}
+
+// POST `body` to `endpoint` with comma-delimited `tags`,
+// optionally `gzipped`, returning the response status.
+func (c *Client) post(ctx context.Context, endpoint, tags string, body []byte, gzipped bool) (*http.Response, error) {
+	client := c.httpClient()
+
+	method, contentType, err := c.request()
+	if err != nil {
+		debug("error: %v", err)
+		return nil, err
+	}
+
+	debug("%s %s with %d bytes", method, endpoint, len(body))
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		debug("error: %v", err)
+		return nil, err
+	}
+
+	if c.UserAgent != "" {
+		req.Header.Add("User-Agent", c.UserAgent)
+	} else {
+		req.Header.Add("User-Agent", "go-loggly (version: "+Version+")")
+	}
+	req.Header.Add("Content-Type", contentType)
+
+	if gzipped {
+		req.Header.Add("Content-Encoding", "gzip")
+	}
+	req.Header.Add("Accept-Encoding", "gzip")
+
+	if tags != "" && c.TagMode == TagModeHeader {
+		req.Header.Add("X-Loggly-Tag", tags)
+	}
+
+	for k, v := range c.Headers {
+		req.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		debug("error: %v", err)
+		return nil, err
+	}
+
+	// read the body so the connection is reused, keeping a copy
+	resp, _ := readBody(res)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(resp))
+
+	debug("%d response", res.StatusCode)
+	if res.StatusCode >= 400 {
+		debug("error: %s", string(resp))
+		err := &FlushError{StatusCode: res.StatusCode, Body: string(resp)}
+		if res.StatusCode == http.StatusTooManyRequests {
+			err.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+		}
+
+		return res, err
+	}
+
+	return res, nil
+}
+
+// Return the status of `res`, 0 when nil.
+func statusOf(res *http.Response) int {
+	if res == nil {
+		return 0
+	}
+
+	return res.StatusCode
+}
+
+// Gzip `body`.
+func compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Read the body of `res`, gunzipping it when encoded, in which case
+// the headers of `res` are updated to describe the decoded body.
+func readBody(res *http.Response) ([]byte, error) {
+	if !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return ioutil.ReadAll(res.Body)
+	}
+
+	r, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = int64(len(b))
+	res.Uncompressed = true
+	return b, err
+}
+
+// Check if `err` is worth retrying: network
+// errors, 429 and 5xx responses.
+func retryable(err error) bool {
+	if e, ok := err.(*FlushError); ok {
+		return e.StatusCode == 429 || e.StatusCode >= 500
+	}
+
+	return !errors.Is(err, ErrInvalidRequest)
+}
+
+// Close stops the flusher, waits for in-flight flushes and
+// flushes remaining messages. Subsequent sends return ErrClosed.
+func (c *Client) Close() error {
+	if c.root != nil {
+		return c.root.Close()
+	}
+
+	if !c.stop() {
+		return nil
+	}
+
+	return c.Flush()
+}
+
+// DrainAndClose stops the flusher and flushes until the buffer is empty
+// or `ctx` is done, returning the last flush error or `ctx.Err()`. Failed
+// flushes are retried after RetryBackoff, or the Retry-After delay.
+func (c *Client) DrainAndClose(ctx context.Context) error {
+	if c.root != nil {
+		return c.root.DrainAndClose(ctx)
+	}
+
+	if !c.stop() {
+		return nil
+	}
+
+	for {
+		err := c.FlushContext(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		c.Lock()
+		n := len(c.buffer)
+		c.Unlock()
+
+		if n == 0 {
+			return err
+		}
+
+		if err != nil {
+			c.Lock()
+			wait := time.Until(c.paused)
+			c.Unlock()
+
+			if wait < c.RetryBackoff {
+				wait = c.RetryBackoff
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Mark the client closed, stop the flusher and wait for in-flight
+// flushes, reporting whether the client was open.
+func (c *Client) stop() bool {
+	c.setup()
+	c.Lock()
+
+	if c.closed {
+		c.Unlock()
+		return false
+	}
+
+	c.closed = true
+	c.cancel()
+	c.space.Broadcast()
+	c.Unlock()
+
+	c.Wait()
+
+	return true
+}
+
+// SetDefault sets the default property `key` to `value`.
+func (c *Client) SetDefault(key string, value interface{}) {
+	if c.root != nil {
+		c.root.SetDefault(key, value)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Defaults == nil {
+		c.Defaults = Message{}
+	}
+
+	c.Defaults[key] = value
+}
+
+// RemoveDefault removes the default property `key`, such as
+// the "hostname" added by the constructors.
+func (c *Client) RemoveDefault(key string) {
+	if c.root != nil {
+		c.root.RemoveDefault(key)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.Defaults, key)
+}
+
+// SetDefaults merges `props` into the default properties.
+func (c *Client) SetDefaults(props Message) {
+	if c.root != nil {
+		c.root.SetDefaults(props)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Defaults == nil {
+		c.Defaults = Message{}
+	}
+
+	Merge(c.Defaults, props)
+}
+
+// With returns a child client sending through the same buffer with
+// `fields` layered over the defaults, winning over them. The child
+// shares everything else with its parent, so methods such as Tag,
+// SetDefault and Close apply to both, and its own exported fields
+// are ignored.
+func (c *Client) With(fields Message) *Client {
+	return &Client{root: c.base(), fields: MergedCopy(c.fields, fields)}
+}
+
+// Context key of the client stored by NewContext.
+type contextKey struct{}
+
+// NewContext returns a copy of `ctx` carrying `c`, such as
+// a child client created with With for a request.
+func NewContext(ctx context.Context, c *Client) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the client stored in `ctx` by NewContext.
+func FromContext(ctx context.Context) (*Client, bool) {
+	c, ok := ctx.Value(contextKey{}).(*Client)
+	return c, ok && c != nil
+}
+
+// Return the client owning the buffer.
+func (c *Client) base() *Client {
+	if c.root != nil {
+		return c.root
+	}
+
+	return c
+}
+
+// Tag adds the given `tags` for all logs, ignoring duplicates.
+// Invalid tags are sanitized, or skipped with StrictTags,
+// returning ErrInvalidTag.
+func (c *Client) Tag(tags ...string) error {
+	if c.root != nil {
+		return c.root.Tag(tags...)
+	}
+
+	tags, err := c.checkTags(tags)
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.addTags(tags)
+	return err
+}
+
+// RemoveTag removes the given `tags`.
+func (c *Client) RemoveTag(tags ...string) {
+	if c.root != nil {
+		c.root.RemoveTag(tags...)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	kept := c.tags[:0]
+	for _, tag := range c.tags {
+		if !contains(tags, tag) {
+			kept = append(kept, tag)
+		}
+	}
+
+	c.tags = kept
+}
+
+// SetTags replaces all tags with the given `tags`, checked as with Tag.
+func (c *Client) SetTags(tags ...string) error {
+	if c.root != nil {
+		return c.root.SetTags(tags...)
+	}
+
+	tags, err := c.checkTags(tags)
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.tags = nil
+	c.addTags(tags)
+	return err
+}
+
+// Return `tags` with invalid ones sanitized, or skipped with
+// StrictTags along with an error for the first of them.
+func (c *Client) checkTags(tags []string) ([]string, error) {
+	var checked []string
+	var err error
+
+	for _, tag := range tags {
+		if validTag(tag) {
+			checked = append(checked, tag)
+			continue
+		}
+
+		if c.StrictTags {
+			if err == nil {
+				err = fmt.Errorf("%w %q", ErrInvalidTag, tag)
+			}
+			continue
+		}
+
+		if s := sanitizeTag(tag); s != "" {
+			debug("sanitized tag %q to %q", tag, s)
+			checked = append(checked, s)
+		} else {
+			debug("dropping tag %q", tag)
+		}
+	}
+
+	return checked, err
+}
+
+// Check if `tag` is accepted by loggly.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > maxTagLength || !alphanumeric(rune(tag[0])) {
+		return false
+	}
+
+	for _, r := range tag {
+		if !alphanumeric(r) && r != '-' && r != '.' && r != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Return `tag` with invalid characters replaced by "_", leading
+// non-alphanumerics removed and truncated to the maximum length.
+func sanitizeTag(tag string) string {
+	tag = strings.Map(func(r rune) rune {
+		if alphanumeric(r) || r == '-' || r == '.' || r == '_' {
+			return r
+		}
+		return '_'
+	}, tag)
+
+	tag = strings.TrimLeftFunc(tag, func(r rune) bool {
+		return !alphanumeric(r)
+	})
+
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+
+	return tag
+}
+
+// Check if `r` is an ASCII letter or digit.
+func alphanumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// Append `tags` not already present. Must be called with the lock held.
+func (c *Client) addTags(tags []string) {
+	for _, tag := range tags {
+		if !contains(c.tags, tag) {
+			c.tags = append(c.tags, tag)
+		}
+	}
+}
+
+// Return a comma-delimited tag list string.
+func (c *Client) tagsList() string {
+	c.Lock()
+	defer c.Unlock()
+
+	return strings.Join(c.tags, ",")
+}
+
+// Return the comma-delimited union of the client's tags
+// and the tags of the messages in `batch`.
+func (c *Client) batchTags(batch []*entry) string {
+	c.Lock()
+	tags := append([]string(nil), c.tags...)
+	c.Unlock()
+
+	for _, e := range batch {
+		for _, tag := range e.tags {
+			if !contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return strings.Join(tags, ",")
+}
+
+// Check if `list` contains `s`.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetToken replaces the token, updating Endpoint when it is the region's
+// end-point for the previous token, even an empty one, or ends with the
+// previous token. Flushes in progress complete with the previous token,
+// later ones use `token`.
+func (c *Client) SetToken(token string) {
+	if c.root != nil {
+		c.root.SetToken(token)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	old := c.Token
+
+	if endpoint, err := endpointFor(c.Region, "bulk", old); err == nil && c.Endpoint == endpoint {
+		c.Endpoint, _ = endpointFor(c.Region, "bulk", token)
+	} else if old != "" && strings.HasSuffix(c.Endpoint, "/"+old) {
+		c.Endpoint = strings.TrimSuffix(c.Endpoint, old) + token
+	}
+
+	c.Token = token
+}
+
+// SetFlushInterval changes the flush interval, taking effect immediately.
+// Intervals other than positive ones are ignored.
+func (c *Client) SetFlushInterval(d time.Duration) {
+	if c.root != nil {
+		c.root.SetFlushInterval(d)
+		return
+	}
+
+	if d <= 0 {
+		debug("ignoring flush interval %v", d)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.FlushInterval = d
+	if c.ticker != nil {
+		c.ticker.Reset(d)
+	}
+}
+
+// Start flusher, flushing on each interval and whenever
+// signalled. Background flushes all run here.
+func (c *Client) start() {
+	c.Lock()
+	c.ticker = time.NewTicker(c.flushInterval())
+	ticks := c.ticker.C
+	c.Unlock()
+
+	defer c.ticker.Stop()
+
+	for {
+		select {
+		case <-ticks:
+			debug("interval reached")
+		case <-c.wake:
+			debug("flush triggered")
+		case <-c.ctx.Done():
+			debug("stopping flusher")
+			return
+		}
+
+		c.Lock()
+		if c.closed {
+			c.Unlock()
+			return
+		}
+		if c.AdaptiveFlush {
+			c.ticker.Reset(c.adaptiveInterval())
+		}
+		if c.idle() {
+			c.stats.emptySkipped.Add(1)
+			c.Unlock()
+			continue
+		}
+		c.inflight.Add(1)
+		c.Unlock()
+
+		err := c.flushAsync()
+		c.inflight.Done()
+
+		// outside the in-flight count, so OnError may call Close
+		if err != nil && c.OnError != nil {
+			c.OnError(err)
+		}
+	}
+}
+
+// Return FlushInterval, or the default when not positive.
+// Must be called with the lock held.
+func (c *Client) flushInterval() time.Duration {
+	if c.FlushInterval <= 0 {
+		return 5 * time.Second
+	}
+
+	return c.FlushInterval
+}
+
+// Check if a flush has nothing to do: no buffered messages, spooled
+// batches or unreported drops. Must be called with the lock held.
+func (c *Client) idle() bool {
+	return c.stats.buffered.Load() == 0 && c.SpoolDir == "" && c.stats.messagesDropped.Load() == c.reported
+}
+
+// Return the flush interval for the current buffer depth, interpolated
+// between MaxFlushInterval when empty and MinFlushInterval when it holds
+// BufferSize messages. Must be called with the lock held.
+func (c *Client) adaptiveInterval() time.Duration {
+	min, max := c.MinFlushInterval, c.MaxFlushInterval
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if max < min {
+		max = min
+	}
+
+	fill := 1.0
+	if c.BufferSize > 0 && len(c.buffer) < c.BufferSize {
+		fill = float64(len(c.buffer)) / float64(c.BufferSize)
+	}
+
+	d := max - time.Duration(fill*float64(max-min))
+	debug("adaptive flush interval %v", d)
+	return d
+}
+
+// Return the level stored in `msg`, defaulting to INFO.
+func levelOf(msg Message) Level {
+	switch v := msg["level"].(type) {
+	case Level:
+		return v
+	case string:
+		if level, ok := levels[strings.ToLower(v)]; ok {
+			return level
+		}
+	}
+
+	return INFO
+}
+
+// Truncate `msg`, marshaled as `json`, to MaxEventBytes. The largest
+// string field is shortened, falling back to the whole message as a
+// string, and a "_truncated" marker added.
+func (c *Client) truncate(msg Message, json []byte) ([]byte, error) {
+	msg = MergedCopy(msg, Message{"_truncated": true})
+
+	if b, ok, err := shrink(c.encode, msg, largest(msg), c.MaxEventBytes); ok || err != nil {
+		return b, err
+	}
+
+	whole := Message{"_truncated": true, c.messageField(): string(json)}
+	for _, k := range []string{c.timestampField(), "level"} {
+		if v, ok := msg[k]; ok {
+			whole[k] = v
+		}
+	}
+
+	b, _, err := shrink(c.encode, whole, c.messageField(), c.MaxEventBytes)
+	return b, err
+}
+
+// Shorten the string `key` of `msg` until it marshals within `limit`.
+func shrink(marshal func(interface{}) ([]byte, error), msg Message, key string, limit int) ([]byte, bool, error) {
+	for {
+		b, err := marshal(msg)
+		if err != nil || len(b) <= limit {
+			return b, err == nil, err
+		}
+
+		s, _ := msg[key].(string)
+		if s == "" {
+			return b, false, nil
+		}
+
+		// escaping may take more than a byte per character,
+		// halve the string when cutting the excess is not enough
+		n := len(s) - (len(b) - limit)
+		if n < 0 {
+			n = len(s) / 2
+		}
+
+		msg[key] = strings.ToValidUTF8(s[:n], "")
+	}
+}
+
+// Return the key of the largest string value in `msg`.
+func largest(msg Message) string {
+	key, size := "", 0
+
+	for k, v := range msg {
+		if s, ok := v.(string); ok && len(s) > size {
+			key, size = k, len(s)
+		}
+	}
+
+	return key
+}
+
+// Return a copy of `msg` with nested messages and maps
+// flattened into dotted keys.
+func flatten(msg Message) Message {
+	c := make(Message, len(msg))
+	flattenInto(c, "", msg)
+	return c
+}
+
+// Copy `msg` into `c`, prefixing keys with `prefix`.
+func flattenInto(c Message, prefix string, msg Message) {
+	for k, v := range msg {
+		var sub Message
+
+		switch t := v.(type) {
+		case Message:
+			sub = t
+		case map[string]interface{}:
+			sub = t
+		}
+
+		if len(sub) > 0 {
+			flattenInto(c, prefix+k+".", sub)
+		} else {
+			c[prefix+k] = v
+		}
+	}
+}
+
+// Replace error values with their message, and format times
+// and durations per TimestampFormat and DurationFormat.
+func (c *Client) normalize(_ string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return c.timestamp(t)
+	case time.Duration:
+		if c.DurationFormat == DurationMillis {
+			return float64(t) / float64(time.Millisecond)
+		}
+		return t.String()
+	case error:
+		return t.Error()
+	}
+
+	return v
+}
+
+// Replace a string holding a JSON number in `key`, per
+// NumericFields, with an int64 or float64.
+func (c *Client) coerce(key string, v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok || s == "" || (len(c.NumericFields) > 0 && !contains(c.NumericFields, key)) {
+		return v
+	}
+
+	if s[0] != '-' && (s[0] < '0' || s[0] > '9') || !Valid([]byte(s)) {
+		return v
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+
+	return v
+}
+
+// WithError returns properties describing `err`, including
+// the messages of any errors it wraps as "error_chain".
+func WithError(err error) Message {
+	if err == nil {
+		return Message{}
+	}
+
+	msg := Message{
+		"error":      err.Error(),
+		"error_type": fmt.Sprintf("%T", err),
+	}
+
+	var chain []string
+	for e := errors.Unwrap(err); e != nil; e = errors.Unwrap(e) {
+		chain = append(chain, e.Error())
+	}
+
+	if len(chain) > 0 {
+		msg["error_chain"] = chain
+	}
+
+	return msg
+}
+
+// Return a copy of `msg` with values of `keys` redacted, recursively.
+func redact(msg Message, keys []string) Message {
+	return walkMessage(msg, func(k string, v interface{}) interface{} {
+		for _, key := range keys {
+			if strings.EqualFold(k, key) {
+				return "[REDACTED]"
+			}
+		}
+
+		return v
+	})
+}
+
+// Return a copy of `msg` with keys sanitized, recursively. Keys already
+// safe keep their name, others are suffixed in order on collision.
+func sanitize(msg Message) Message {
+	keys := make([]string, 0, len(msg))
+	for k := range msg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	c := make(Message, len(msg))
+	var renamed []string
+
+	for _, k := range keys {
+		if sanitizeKey(k) == k {
+			c[k] = sanitizeValue(msg[k])
+		} else {
+			renamed = append(renamed, k)
+		}
+	}
+
+	for _, k := range renamed {
+		base := sanitizeKey(k)
+		name := base
+		for i := 2; ; i++ {
+			if _, taken := c[name]; !taken {
+				break
+			}
+			name = base + "_" + strconv.Itoa(i)
+		}
+
+		c[name] = sanitizeValue(msg[k])
+	}
+
+	return c
+}
+
+// Sanitize the keys of `v` if it is a message, map or slice.
+func sanitizeValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case Message:
+		return sanitize(t)
+	case map[string]interface{}:
+		return map[string]interface{}(sanitize(t))
+	case []Message:
+		c := make([]Message, len(t))
+		for i, msg := range t {
+			c[i] = sanitize(msg)
+		}
+		return c
+	case []map[string]interface{}:
+		c := make([]map[string]interface{}, len(t))
+		for i, msg := range t {
+			c[i] = sanitize(msg)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(t))
+		for i, e := range t {
+			c[i] = sanitizeValue(e)
+		}
+		return c
+	}
+
+	return v
+}
+
+// Return `key` with unsafe characters replaced by "_",
+// prefixed with "_" when it is empty or starts with a digit.
+func sanitizeKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		return "_" + key
+	}
+
+	return key
+}
+
+// Return a copy of `msg` with each value replaced by `fn(key, value)`,
+// recursing into nested messages, maps and slices of them.
+func walkMessage(msg Message, fn func(string, interface{}) interface{}) Message {
+	c := make(Message, len(msg))
+
+	for k, v := range msg {
+		c[k] = fn(k, walk(v, fn))
+	}
+
+	return c
+}
+
+// Walk `v` if it is a message, map or slice.
+func walk(v interface{}, fn func(string, interface{}) interface{}) interface{} {
+	switch t := v.(type) {
+	case Message:
+		return walkMessage(t, fn)
+	case map[string]interface{}:
+		return map[string]interface{}(walkMessage(t, fn))
+	case []Message:
+		c := make([]Message, len(t))
+		for i, msg := range t {
+			c[i] = walkMessage(msg, fn)
+		}
+		return c
+	case []map[string]interface{}:
+		c := make([]map[string]interface{}, len(t))
+		for i, msg := range t {
+			c[i] = walkMessage(msg, fn)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(t))
+		for i, e := range t {
+			c[i] = walk(e, fn)
+		}
+		return c
+	}
+
+	return v
+}
+
+// Merge others into a, mutating a. See MergedCopy
+// for a non-destructive alternative.
+func Merge(a Message, others ...Message) {
+	for _, msg := range others {
+		for k, v := range msg {
+			a[k] = v
+		}
+	}
+}
+
+// MergedCopy returns a new message with the keys of `msgs`
+// copied left-to-right, later keys winning. Inputs are untouched.
+func MergedCopy(msgs ...Message) Message {
+	n := 0
+	for _, msg := range msgs {
+		n += len(msg)
+	}
+
+	c := make(Message, n)
+	Merge(c, msgs...)
+	return c
 }
@@ -0,0 +1,2173 @@
+package loggly
+
+import . "encoding/json"
+import "net/http/httptest"
+import "compress/gzip"
+import "crypto/x509"
+import "crypto/tls"
+import "path/filepath"
+import "os/signal"
+import "io/ioutil"
+import "log/slog"
+import "net/http"
+import "runtime"
+import "strings"
+import "syscall"
+import "testing"
+import "context"
+import "errors"
+import "bytes"
+import "sort"
+import "sync"
+import "time"
+import "fmt"
+import "os"
+
+// Request received by a test server.
+type request struct {
+	method string
+	path   string
+	header http.Header
+	length int64
+	body   []byte
+}
+
+// Server recording the requests it receives.
+type server struct {
+	*httptest.Server
+	requests []request
+	sync.Mutex
+}
+
+// Return a started server recording requests, then answering with
+// `handler`, which may read the body again, or 200 when nil. Closed
+// when the test ends.
+func newServer(t *testing.T, handler http.HandlerFunc) *server {
+	s := &server{}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.Lock()
+		s.requests = append(s.requests, request{
+			method: r.Method,
+			path:   r.URL.Path,
+			header: r.Header.Clone(),
+			length: r.ContentLength,
+			body:   body,
+		})
+		s.Unlock()
+
+		if handler != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			handler(w, r)
+		}
+	}))
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Return the requests received so far.
+func (s *server) received() []request {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]request(nil), s.requests...)
+}
+
+// Return the only request received, failing the test otherwise.
+func (s *server) only(t *testing.T) request {
+	t.Helper()
+
+	requests := s.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+
+	return requests[0]
+}
+
+// Return a client sending to `s`, only flushing when told to
+// and retrying quickly. Closed when the test ends.
+func newTestClient(t *testing.T, s *server) *Client {
+	c := New("token")
+	c.Endpoint = s.URL + "/bulk/token"
+	c.BufferSize = 1000
+	c.RetryBackoff = time.Millisecond
+	c.SetFlushInterval(time.Hour)
+
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Return the buffered messages of `c`, failing the test
+// when one is not a JSON object.
+func buffered(t *testing.T, c *Client) []Message {
+	t.Helper()
+
+	c.Lock()
+	defer c.Unlock()
+
+	var msgs []Message
+	for _, e := range c.buffer {
+		var msg Message
+		if err := Unmarshal(e.bytes(), &msg); err != nil {
+			t.Fatalf("invalid message %s: %v", e.bytes(), err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+func TestContentLength(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+
+	c.Send(Message{"hello": "world"})
+	c.Send(Message{"hello": "again"})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := s.only(t)
+	if r.length != int64(len(r.body)) {
+		t.Fatalf("expected Content-Length %d, got %d", len(r.body), r.length)
+	}
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	var mu sync.Mutex
+	failures := 2
+
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	c := newTestClient(t, s)
+
+	c.Send(Message{"hello": "world"})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := s.received()
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	for _, r := range requests {
+		if !bytes.Contains(r.body, []byte(`"hello":"world"`)) {
+			t.Fatalf("unexpected body %s", r.body)
+		}
+	}
+
+	if s := c.Stats(); s.MessagesSent != 1 || s.FlushErrors != 2 {
+		t.Fatalf("expected 1 message sent after 2 errors, got %+v", s)
+	}
+}
+
+func TestRetryGivesUpOnRejection(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	c := newTestClient(t, s)
+
+	c.Send(Message{"hello": "world"})
+
+	if err := c.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	s.only(t)
+}
+
+func TestCompression(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+	c.CompressionThreshold = 1024
+
+	var lines [][]byte
+	for i := 0; i < 100; i++ {
+		line := []byte(fmt.Sprintf(`{"message":"hello","n":%d}`, i))
+		lines = append(lines, line)
+		c.Write(line)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := s.only(t)
+	if r.header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", r.header.Get("Content-Encoding"))
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(r.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := bytes.Join(lines, nl); !bytes.Equal(body, want) {
+		t.Fatalf("expected body %s, got %s", want, body)
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+	c.CompressionThreshold = 1024
+
+	c.Write([]byte(`{"message":"hello"}`))
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := s.only(t); r.header.Get("Content-Encoding") != "" || string(r.body) != `{"message":"hello"}` {
+		t.Fatalf("expected an uncompressed body, got %q", r.body)
+	}
+}
+
+func TestNoOverlappingFlushes(t *testing.T) {
+	var mu sync.Mutex
+	active, overlaps := 0, 0
+
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > 1 {
+			overlaps++
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+	})
+	c := newTestClient(t, s)
+	c.BufferSize = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.Send(Message{"goroutine": i, "n": j})
+				if j%10 == 0 {
+					c.Flush()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if overlaps > 0 {
+		t.Fatalf("expected no overlapping requests, got %d", overlaps)
+	}
+
+	if n := c.Stats().MessagesSent; n != 1000 {
+		t.Fatalf("expected 1000 messages sent, got %d", n)
+	}
+}
+
+func TestFlushClientLiteral(t *testing.T) {
+	s := newServer(t, nil)
+	c := &Client{Endpoint: s.URL + "/bulk/token"}
+
+	c.Send(Message{"hello": "world"})
+
+	done := make(chan error, 1)
+	go func() { done <- c.Flush() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush hung")
+	}
+
+	s.only(t)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSlogHandlerLevels(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	h := c.SlogHandler(&slog.HandlerOptions{Level: slog.LevelDebug})
+	if h.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("expected records below the client level to be disabled")
+	}
+
+	if !h.Enabled(context.Background(), slog.LevelInfo) {
+		t.Fatal("expected records at the client level to be enabled")
+	}
+
+	h = c.SlogHandler(&slog.HandlerOptions{Level: slog.LevelWarn})
+	if h.Enabled(context.Background(), slog.LevelInfo) {
+		t.Fatal("expected records below opts.Level to be disabled")
+	}
+
+	slog.New(h).Warn("hello")
+	if n := c.Pending(); n != 1 {
+		t.Fatalf("expected 1 buffered message, got %d", n)
+	}
+}
+
+func TestSlogReplaceAttr(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	var seen []string
+	h := c.SlogHandler(&slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if groups == nil {
+				seen = append(seen, a.Key)
+			}
+
+			switch a.Key {
+			case slog.TimeKey:
+				return slog.Attr{}
+			case slog.MessageKey:
+				a.Key = "text"
+			case slog.LevelKey:
+				a.Value = slog.StringValue("LOUD")
+			}
+			return a
+		},
+	})
+
+	slog.New(h).Warn("hello", "user", "tobi")
+
+	msg := buffered(t, c)[0]
+	if msg["text"] != "hello" || msg["message"] != nil || msg["level"] != "LOUD" || msg["user"] != "tobi" {
+		t.Fatalf("expected the built-ins replaced, got %v", msg)
+	}
+
+	if want := "user,time,level,msg"; strings.Join(seen, ",") != want {
+		t.Fatalf("expected ReplaceAttr called with %s, got %v", want, seen)
+	}
+}
+
+func TestSlogAddSource(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.Source = "billing"
+
+	slog.New(c.SlogHandler(&slog.HandlerOptions{AddSource: true})).Info("hello")
+
+	msg := buffered(t, c)[0]
+	if msg["source"] != "billing" {
+		t.Fatalf("expected the client's source kept, got %v", msg)
+	}
+
+	if caller, _ := msg["caller"].(string); !strings.Contains(caller, "loggly_test.go:") {
+		t.Fatalf("expected the record's source as caller, got %v", msg)
+	}
+}
+
+func TestTags(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+
+	expect := func(want string) {
+		t.Helper()
+		if got := c.tagsList(); got != want {
+			t.Fatalf("expected tags %q, got %q", want, got)
+		}
+	}
+
+	c.Tag("web", "api", "web")
+	c.Tag("api")
+	expect("web,api")
+
+	c.RemoveTag("web")
+	expect("api")
+
+	c.Tag("web")
+	expect("api,web")
+
+	c.RemoveTag("missing")
+	expect("api,web")
+
+	c.SetTags("a", "b", "a")
+	expect("a,b")
+
+	c.Tag("c")
+	c.RemoveTag("a", "b")
+	expect("c")
+
+	c.SetTags()
+	expect("")
+
+	c.Tag("web")
+	c.Send(Message{"hello": "world"})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tag := s.only(t).header.Get("X-Loggly-Tag"); tag != "web" {
+		t.Fatalf("expected X-Loggly-Tag %q, got %q", "web", tag)
+	}
+}
+
+func TestRedactKeys(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.RedactKeys = []string{"password", "ssn", "authorization"}
+
+	c.Send(Message{
+		"Authorization": "Bearer secret",
+		"user": Message{
+			"name":     "tobi",
+			"Password": "secret",
+			"profile": map[string]interface{}{
+				"ssn":  "123-45-6789",
+				"city": "Victoria",
+			},
+		},
+		"accounts": []Message{
+			{"id": 1, "password": "secret"},
+			{"id": 2, "password": "secret"},
+		},
+		"events": []interface{}{
+			map[string]interface{}{"ssn": "123-45-6789", "kind": "login"},
+		},
+	})
+
+	msgs := buffered(t, c)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+
+	b, _ := Marshal(msgs[0])
+	if bytes.Contains(b, []byte("secret")) || bytes.Contains(b, []byte("123-45-6789")) {
+		t.Fatalf("expected every sensitive value redacted, got %s", b)
+	}
+
+	if n := bytes.Count(b, []byte(`"[REDACTED]"`)); n != 6 {
+		t.Fatalf("expected 6 redacted values, got %d in %s", n, b)
+	}
+
+	for _, kept := range []string{`"name":"tobi"`, `"city":"Victoria"`, `"id":2`, `"kind":"login"`} {
+		if !bytes.Contains(b, []byte(kept)) {
+			t.Fatalf("expected %s unchanged, got %s", kept, b)
+		}
+	}
+}
+
+func TestMaxEventBytes(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.MaxEventBytes = 256
+
+	c.Send(Message{"message": "crashed", "stack": strings.Repeat("frame\n", 1000)})
+
+	c.Lock()
+	data := c.buffer[0].data
+	c.Unlock()
+
+	if len(data) > c.MaxEventBytes {
+		t.Fatalf("expected at most %d bytes, got %d", c.MaxEventBytes, len(data))
+	}
+
+	msg := buffered(t, c)[0]
+	if msg["_truncated"] != true {
+		t.Fatalf("expected a _truncated marker, got %v", msg)
+	}
+
+	if msg["message"] != "crashed" {
+		t.Fatalf("expected the message kept, got %v", msg["message"])
+	}
+
+	if stack, _ := msg["stack"].(string); !strings.HasPrefix(stack, "frame\n") {
+		t.Fatalf("expected a shortened stack, got %q", stack)
+	}
+}
+
+func TestFormatJSONArray(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		s := newServer(t, nil)
+		c := newTestClient(t, s)
+		c.Format = FormatJSONArray
+
+		for i := 0; i < n; i++ {
+			c.Send(Message{"n": i})
+		}
+
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := s.only(t)
+		if ct := r.header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("expected Content-Type application/json, got %q", ct)
+		}
+
+		var msgs []Message
+		if err := Unmarshal(r.body, &msgs); err != nil {
+			t.Fatalf("expected a JSON array, got %s: %v", r.body, err)
+		}
+
+		if len(msgs) != n {
+			t.Fatalf("expected %d elements, got %d", n, len(msgs))
+		}
+	}
+}
+
+func TestSetFlushInterval(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+
+	c.Send(Message{"n": 1})
+	c.SetFlushInterval(10 * time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a flush at the new interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.SetFlushInterval(time.Hour)
+	c.Wait()
+	c.Send(Message{"n": 2})
+	time.Sleep(100 * time.Millisecond)
+
+	if n := len(s.received()); n != 1 {
+		t.Fatalf("expected no flush at the longer interval, got %d requests", n)
+	}
+
+	c.SetFlushInterval(0)
+	c.SetFlushInterval(-time.Second)
+
+	if c.FlushInterval != time.Hour {
+		t.Fatalf("expected non-positive intervals ignored, got %v", c.FlushInterval)
+	}
+}
+
+func TestFlushIntervalDefault(t *testing.T) {
+	c := NewWithOptions("token", WithFlushInterval(0), func(c *Client) { c.DryRun = true })
+	defer c.Close()
+
+	// the flusher would panic creating its ticker
+	time.Sleep(10 * time.Millisecond)
+	c.Send(Message{"n": 1})
+}
+
+func TestIncludeCaller(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.IncludeCaller = true
+	c.CaptureStack = true
+
+	_, _, line, _ := runtime.Caller(0)
+	c.Error("boom", nil)
+	c.Info("hello", nil)
+
+	msgs := buffered(t, c)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+
+	for _, msg := range msgs {
+		if file, _ := msg["file"].(string); filepath.Base(file) != "loggly_test.go" {
+			t.Fatalf("expected the caller in loggly_test.go, got %q", file)
+		}
+	}
+
+	if got := msgs[0]["line"]; got != float64(line+1) {
+		t.Fatalf("expected line %d, got %v", line+1, got)
+	}
+
+	if stack, _ := msgs[0]["stack"].(string); !strings.Contains(stack, "TestIncludeCaller") {
+		t.Fatalf("expected a stack for Error, got %q", stack)
+	}
+
+	if _, ok := msgs[1]["stack"]; ok {
+		t.Fatal("expected no stack for Info")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+	c.Dedup = true
+
+	for i := 0; i < 3; i++ {
+		c.Send(Message{"message": "retrying", "count": 5})
+	}
+	c.Send(Message{"message": "done"})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(s.only(t).body, nl)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(lines))
+	}
+
+	var msg Message
+	if err := Unmarshal(lines[0], &msg); err != nil {
+		t.Fatalf("invalid message %s: %v", lines[0], err)
+	}
+
+	if bytes.Count(lines[0], []byte(`"count"`)) != 1 || msg["count"] != float64(5) || msg["_count"] != float64(3) {
+		t.Fatalf("expected the message count kept and a _count of 3, got %s", lines[0])
+	}
+
+	if bytes.Contains(lines[1], []byte("_count")) {
+		t.Fatalf("expected no _count for a unique message, got %s", lines[1])
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	down := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	c := newTestClient(t, down)
+	c.SpoolDir = dir
+	c.MaxRetries = 0
+
+	c.Send(Message{"message": "spooled"})
+
+	if err := c.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if files := spooled(dir); len(files) != 1 {
+		t.Fatalf("expected 1 spooled batch, got %d", len(files))
+	}
+
+	// a new process finds the batch left behind
+	up := newServer(t, nil)
+	c = newTestClient(t, up)
+	c.SpoolDir = dir
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := up.only(t).body; !bytes.Contains(body, []byte(`"message":"spooled"`)) {
+		t.Fatalf("expected the spooled message, got %s", body)
+	}
+
+	if files := spooled(dir); len(files) != 0 {
+		t.Fatalf("expected the spool emptied, got %d batches", len(files))
+	}
+}
+
+func TestSetDefaultConcurrently(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.SetDefault("deploy_id", j)
+				c.SetDefaults(Message{"worker": i})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Send(Message{"n": j})
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.SetDefault("deploy_id", "final")
+	c.Send(Message{"n": "last"})
+
+	msgs := buffered(t, c)
+	if last := msgs[len(msgs)-1]; last["deploy_id"] != "final" {
+		t.Fatalf("expected the final default, got %v", last["deploy_id"])
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	calls := 0
+	c.Marshal = func(v interface{}) ([]byte, error) {
+		calls++
+
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(v)
+		return buf.Bytes(), err
+	}
+
+	c.Send(Message{"html": "<b>bold</b> & more"})
+
+	if calls != 1 {
+		t.Fatalf("expected the marshaler called once, got %d", calls)
+	}
+
+	c.Lock()
+	data := c.buffer[0].data
+	c.Unlock()
+
+	if !bytes.Contains(data, []byte(`"html":"<b>bold</b> & more"`)) || bytes.HasSuffix(data, nl) {
+		t.Fatalf("expected unescaped HTML without a trailing newline, got %q", data)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.Flatten = true
+	c.RemoveDefault("hostname")
+
+	c.Send(Message{
+		"timestamp": 1,
+		"req": Message{
+			"method": "GET",
+			"headers": map[string]interface{}{
+				"host": "example.com",
+				"auth": Message{"scheme": "basic"},
+			},
+		},
+		"items": []Message{{"id": 1}},
+		"empty": Message{},
+	})
+
+	msg := buffered(t, c)[0]
+
+	var keys []string
+	for k := range msg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	want := "empty,items,req.headers.auth.scheme,req.headers.host,req.method,timestamp"
+	if got := strings.Join(keys, ","); got != want {
+		t.Fatalf("expected keys %s, got %s", want, got)
+	}
+
+	if items, _ := msg["items"].([]interface{}); len(items) != 1 {
+		t.Fatalf("expected slices left intact, got %v", msg["items"])
+	}
+}
+
+func TestRetryAfterPauses(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	c := newTestClient(t, s)
+	c.MaxRetries = 2
+
+	c.Send(Message{"hello": "world"})
+
+	start := time.Now()
+	err := c.Flush()
+
+	if d := retryAfter(err); d != time.Hour {
+		t.Fatalf("expected a Retry-After of 1h, got %v (%v)", d, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the flush to return at once, took %v", elapsed)
+	}
+
+	s.only(t)
+
+	if n := c.Pending(); n != 1 {
+		t.Fatalf("expected the message requeued, got %d pending", n)
+	}
+
+	// background flushes wait for the delay
+	c.signal()
+	time.Sleep(50 * time.Millisecond)
+	s.only(t)
+
+	c.Reset()
+}
+
+func TestDrainAndCloseHonorsRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	c := newTestClient(t, s)
+
+	c.Send(Message{"hello": "world"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.DrainAndClose(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(times) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(times))
+	}
+
+	if d := times[1].Sub(times[0]); d < 900*time.Millisecond {
+		t.Fatalf("expected the retry after the Retry-After delay, got %v", d)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+
+	c.Send(Message{"n": 1})
+	c.Flush()
+
+	if ua := s.received()[0].header.Get("User-Agent"); ua != "go-loggly (version: "+Version+")" {
+		t.Fatalf("expected the default User-Agent, got %q", ua)
+	}
+
+	c.UserAgent = "billing/1.2.3"
+	c.Send(Message{"n": 2})
+	c.Flush()
+
+	if ua := s.received()[1].header.Get("User-Agent"); ua != "billing/1.2.3" {
+		t.Fatalf("expected the custom User-Agent, got %q", ua)
+	}
+}
+
+func TestMarshalFailureDegrades(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	if err := c.Send(Message{"message": "hello", "ch": make(chan int)}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := buffered(t, c)
+	if len(msgs) != 1 {
+		t.Fatalf("expected the message kept, got %d", len(msgs))
+	}
+
+	msg := msgs[0]
+	if msg["message"] != "hello" {
+		t.Fatalf("expected marshalable fields kept, got %v", msg)
+	}
+
+	if ch, _ := msg["ch"].(string); !strings.HasPrefix(ch, "0x") {
+		t.Fatalf("expected the channel formatted with %%v, got %v", msg["ch"])
+	}
+
+	if e, _ := msg["_marshal_error"].(string); !strings.Contains(e, "chan int") {
+		t.Fatalf("expected a _marshal_error marker, got %v", msg["_marshal_error"])
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	c := New("token")
+	defer c.Close()
+	c.Endpoint = s.URL + "/bulk/token"
+	c.TLSConfig = &tls.Config{RootCAs: pool}
+
+	c.Send(Message{"hello": "world"})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	n := len(bodies)
+	mu.Unlock()
+
+	if n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+
+	// an explicit client wins over TLSConfig
+	untrusted := New("token")
+	defer untrusted.Close()
+	untrusted.Endpoint = s.URL + "/bulk/token"
+	untrusted.TLSConfig = &tls.Config{RootCAs: pool}
+	untrusted.HTTPClient = &http.Client{}
+	untrusted.MaxRetries = 0
+
+	untrusted.Send(Message{"hello": "world"})
+
+	if err := untrusted.Flush(); err == nil {
+		t.Fatal("expected a certificate error")
+	}
+
+	untrusted.Reset()
+}
+
+func BenchmarkSendGoroutines(b *testing.B) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer s.Close()
+
+	c := New("token")
+	defer c.Close()
+	c.Endpoint = s.URL + "/bulk/token"
+	c.BufferSize = 10
+
+	before := runtime.NumGoroutine()
+
+	var mu sync.Mutex
+	peak := before
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Send(Message{"message": "hello"})
+
+			n := runtime.NumGoroutine()
+
+			mu.Lock()
+			if n > peak {
+				peak = n
+			}
+			mu.Unlock()
+		}
+	})
+
+	b.ReportMetric(float64(peak-before), "goroutines")
+
+	// the parallel senders, the flusher and connections,
+	// rather than a goroutine per flush
+	if workers := runtime.GOMAXPROCS(0); peak-before > workers+10 {
+		b.Fatalf("expected a stable goroutine count, grew by %d", peak-before)
+	}
+}
+
+func TestGzipErrorResponse(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusBadRequest)
+
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(`{"response":"invalid token"}`))
+		zw.Close()
+	})
+	c := newTestClient(t, s)
+
+	c.Send(Message{"hello": "world"})
+
+	var e *FlushError
+	if err := c.Flush(); !errors.As(err, &e) {
+		t.Fatalf("expected a FlushError, got %v", err)
+	}
+
+	if e.Body != `{"response":"invalid token"}` {
+		t.Fatalf("expected the decoded body, got %q", e.Body)
+	}
+
+	if ae := s.only(t).header.Get("Accept-Encoding"); ae != "gzip" {
+		t.Fatalf("expected Accept-Encoding gzip, got %q", ae)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	var order []string
+	c.Hooks = []func(Message) (Message, bool){
+		func(msg Message) (Message, bool) {
+			order = append(order, "drop")
+			return msg, msg["drop"] != true
+		},
+		func(msg Message) (Message, bool) {
+			order = append(order, "enrich")
+			msg["env"] = msg["hostname"] != nil
+			return msg, true
+		},
+		func(msg Message) (Message, bool) {
+			order = append(order, "replace")
+			return Message{"replaced": msg["env"]}, true
+		},
+	}
+
+	c.Send(Message{"drop": true})
+
+	if got := strings.Join(order, ","); got != "drop" {
+		t.Fatalf("expected the chain to stop at the dropping hook, ran %s", got)
+	}
+
+	order = nil
+	c.Send(Message{"message": "kept"})
+
+	if got := strings.Join(order, ","); got != "drop,enrich,replace" {
+		t.Fatalf("expected the hooks to run in order, ran %s", got)
+	}
+
+	msgs := buffered(t, c)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+
+	// defaults are merged before hooks, the timestamp after
+	if msgs[0]["replaced"] != true || msgs[0]["message"] != nil || msgs[0]["timestamp"] == nil {
+		t.Fatalf("expected the replaced message, got %v", msgs[0])
+	}
+}
+
+func TestFlusherRecoversFromPanic(t *testing.T) {
+	s := newServer(t, nil)
+
+	errs := make(chan error, 10)
+	var mu sync.Mutex
+	panicked := false
+
+	c := newTestClient(t, s)
+	c.OnError = func(err error) { errs <- err }
+	c.OnFlush = func(FlushResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !panicked {
+			panicked = true
+			panic("hook failed")
+		}
+	}
+
+	c.Send(Message{"n": 1})
+	c.signal()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrFlushPanic) {
+			t.Fatalf("expected ErrFlushPanic, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the panic reported")
+	}
+
+	c.Send(Message{"n": 2})
+	c.signal()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.received()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the flusher to keep running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{DEBUG, INFO, WARNING, ERROR, FATAL} {
+		for _, name := range []string{level.String(), strings.ToUpper(level.String())} {
+			got, err := ParseLevel(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != level {
+				t.Fatalf("expected %q to parse as %v, got %v", name, level, got)
+			}
+		}
+	}
+
+	if level, err := ParseLevel("warn"); err != nil || level != WARNING {
+		t.Fatalf("expected warn to parse as warning, got %v, %v", level, err)
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+
+	if s := Level(42).String(); s != "level(42)" {
+		t.Fatalf("expected level(42), got %q", s)
+	}
+}
+
+func TestRequeueDuringSends(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	delivered := map[float64]int{}
+
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if requests%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		for _, line := range bytes.Split(body, nl) {
+			var msg Message
+			Unmarshal(line, &msg)
+			delivered[msg["id"].(float64)]++
+		}
+	})
+	c := newTestClient(t, s)
+	c.BufferSize = 20
+	c.MaxRetries = 0
+	c.PreserveOrder = true
+
+	const senders, each = 8, 250
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				c.Send(Message{"id": i*each + j})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.DrainAndClose(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(delivered) != senders*each {
+		t.Fatalf("expected %d messages delivered, got %d", senders*each, len(delivered))
+	}
+
+	for id, n := range delivered {
+		if n != 1 {
+			t.Fatalf("expected message %v delivered once, got %d", id, n)
+		}
+	}
+
+	if dropped := c.Stats().MessagesDropped; dropped != 0 {
+		t.Fatalf("expected no drops, got %d", dropped)
+	}
+}
+
+func TestRequiredFields(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.RequiredFields = []string{"service", "env"}
+
+	err := c.Send(Message{"service": "billing"})
+	if !errors.Is(err, ErrMissingField) || !strings.Contains(err.Error(), `"env"`) {
+		t.Fatalf("expected ErrMissingField for env, got %v", err)
+	}
+
+	if n := c.Pending(); n != 0 {
+		t.Fatalf("expected the message rejected, got %d pending", n)
+	}
+
+	c.SetDefault("env", "production")
+
+	if err := c.Send(Message{"service": "billing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := buffered(t, c)[0]; msg["env"] != "production" || msg["service"] != "billing" {
+		t.Fatalf("expected env filled from the defaults, got %v", msg)
+	}
+}
+
+func TestTimesAndDurations(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	msg := Message{
+		"at":      at,
+		"elapsed": 1500 * time.Millisecond,
+		"req": Message{
+			"latency": 250 * time.Millisecond,
+			"spans":   []interface{}{map[string]interface{}{"took": time.Second, "start": at}},
+		},
+	}
+
+	c.Send(msg)
+	c.TimestampFormat = TimestampRFC3339
+	c.DurationFormat = DurationMillis
+	c.Send(msg)
+
+	msgs := buffered(t, c)
+	span := func(m Message) map[string]interface{} {
+		return m["req"].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	}
+
+	if m := msgs[0]; m["at"] != float64(at.UnixNano()/int64(time.Millisecond)) || m["elapsed"] != "1.5s" ||
+		m["req"].(map[string]interface{})["latency"] != "250ms" || span(m)["took"] != "1s" {
+		t.Fatalf("expected millisecond times and duration strings, got %v", m)
+	}
+
+	if m := msgs[1]; m["at"] != "2024-03-01T12:00:00Z" || m["elapsed"] != float64(1500) ||
+		m["req"].(map[string]interface{})["latency"] != float64(250) || span(m)["start"] != "2024-03-01T12:00:00Z" {
+		t.Fatalf("expected RFC3339 times and millisecond durations, got %v", m)
+	}
+}
+
+func TestWithRegion(t *testing.T) {
+	for _, region := range []string{"eu", "EU"} {
+		c := NewWithOptions("token", WithRegion(region), func(c *Client) { c.DryRun = true })
+		defer c.Close()
+
+		if c.Region != "eu" || c.Endpoint != "https://logs-01.eu.loggly.com/bulk/token" || c.Validate() != nil {
+			t.Fatalf("expected the eu end-point for %q, got %q %q", region, c.Region, c.Endpoint)
+		}
+	}
+
+	c := NewWithOptions("token", WithRegion("mars"), func(c *Client) { c.DryRun = true })
+
+	if c.Endpoint != "" {
+		t.Fatalf("expected no end-point for an unknown region, got %q", c.Endpoint)
+	}
+
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), `unknown region "mars"`) {
+		t.Fatalf("expected Validate to report the region, got %v", err)
+	}
+
+	c.Send(Message{"hello": "world"})
+
+	if err := c.Flush(); err == nil || !strings.Contains(err.Error(), "unknown region") {
+		t.Fatalf("expected the flush to report the region, got %v", err)
+	}
+
+	if n := c.Pending(); n != 1 {
+		t.Fatalf("expected the message kept, got %d pending", n)
+	}
+
+	c.Reset()
+	c.Close()
+
+	if _, err := NewWithRegion("token", "Mars"); err == nil {
+		t.Fatal("expected NewWithRegion to reject an unknown region")
+	}
+}
+
+func TestOnFlush(t *testing.T) {
+	var mu sync.Mutex
+	status := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest}
+
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.WriteHeader(status[0])
+		status = status[1:]
+	})
+	c := newTestClient(t, s)
+
+	var results []FlushResult
+	c.OnFlush = func(r FlushResult) {
+		results = append(results, r)
+	}
+
+	c.Send(Message{"hello": "world"})
+	c.Send(Message{"hello": "again"})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Send(Message{"hello": "rejected"})
+
+	if err := c.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+
+	if r := results[0]; r.Messages != 2 || r.Attempts != 2 || r.StatusCode != 200 || r.Err != nil || r.Bytes == 0 {
+		t.Fatalf("unexpected result of the delivered batch %+v", r)
+	}
+
+	if r := results[1]; r.Messages != 1 || r.Attempts != 1 || r.StatusCode != 400 || r.Err == nil {
+		t.Fatalf("unexpected result of the rejected batch %+v", r)
+	}
+}
+
+func TestSanitizeKeys(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.SanitizeKeys = true
+
+	c.Send(Message{
+		"user_name": "kept",
+		"user name": "space",
+		"user.name": "dot",
+		"1st":       "digit",
+		"":          "empty",
+		"héllo":     "unicode",
+		"nested":    Message{"a b": []interface{}{map[string]interface{}{"c:d": 1}}},
+	})
+
+	msg := buffered(t, c)[0]
+
+	for k, v := range map[string]interface{}{
+		"user_name":   "kept",
+		"user_name_2": "space",
+		"user_name_3": "dot",
+		"_1st":        "digit",
+		"_":           "empty",
+		"h_llo":       "unicode",
+	} {
+		if msg[k] != v {
+			t.Fatalf("expected %q to be %v, got %v", k, v, msg)
+		}
+	}
+
+	nested := msg["nested"].(map[string]interface{})["a_b"].([]interface{})[0].(map[string]interface{})
+	if nested["c_d"] != float64(1) {
+		t.Fatalf("expected nested keys sanitized, got %v", msg["nested"])
+	}
+}
+
+func TestFlushOnSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be raised on windows")
+	}
+
+	// Keeps the raised signal from hanging up the test binary.
+	keep := make(chan os.Signal, 2)
+	signal.Notify(keep, syscall.SIGHUP)
+	defer signal.Stop(keep)
+
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+	stop := c.FlushOnSignal(syscall.SIGHUP)
+	defer stop()
+
+	c.Send(Message{"hello": "world"})
+	p, _ := os.FindProcess(os.Getpid())
+	p.Signal(syscall.SIGHUP)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-keep:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the signal to be received, then raised again")
+		}
+	}
+
+	if r := s.only(t); !bytes.Contains(r.body, []byte(`"hello":"world"`)) {
+		t.Fatalf("unexpected body %s", r.body)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if j := c.jitter(d); j != d {
+			t.Fatalf("expected %v unchanged, got %v", d, j)
+		}
+	}
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		j := c.jitter(time.Second)
+		if j < 0 || j >= time.Second {
+			t.Fatalf("expected jitter in [0, 1s), got %v", j)
+		}
+		seen[j] = true
+	}
+
+	if len(seen) < 2 {
+		t.Fatal("expected jitter to vary")
+	}
+}
+
+func TestRetryWithJitter(t *testing.T) {
+	var mu sync.Mutex
+	failures := 3
+
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	c := newTestClient(t, s)
+	c.RetryBackoff = 100 * time.Millisecond
+	c.Jitter = true
+
+	c.Send(Message{"hello": "world"})
+
+	// The backoffs add up to less than 700ms, the rest allowing
+	// for slow requests.
+	start := time.Now()
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= 1200*time.Millisecond {
+		t.Fatalf("expected jittered backoffs below 700ms, took %v", elapsed)
+	}
+
+	if n := len(s.received()); n != 4 {
+		t.Fatalf("expected 4 requests, got %d", n)
+	}
+}
+
+func TestTee(t *testing.T) {
+	a, b := newServer(t, nil), newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	m := Tee(newTestClient(t, a), newTestClient(t, b))
+
+	if err := m.Send(Message{"hello": "world"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Flush(); err == nil {
+		t.Fatal("expected the error of the failing client")
+	}
+
+	for _, s := range []*server{a, b} {
+		if r := s.only(t); !bytes.Contains(r.body, []byte(`"hello":"world"`)) {
+			t.Fatalf("unexpected body %s", r.body)
+		}
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.MessageField = "msg"
+	c.SetDefault("service", "billing")
+
+	for _, b := range []string{`{"hello":"world"}`, "not json\n", "null", `["array"]`} {
+		if err := c.WriteMessage([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs := buffered(t, c)
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(msgs))
+	}
+
+	for i, want := range []string{"", "not json", "null", `["array"]`} {
+		msg := msgs[i]
+		if msg["service"] != "billing" || msg["timestamp"] == nil {
+			t.Fatalf("expected defaults and a timestamp, got %v", msg)
+		}
+
+		if want == "" {
+			if msg["hello"] != "world" || msg["msg"] != nil {
+				t.Fatalf("expected the object sent as is, got %v", msg)
+			}
+		} else if msg["msg"] != want {
+			t.Fatalf("expected %q as the message, got %v", want, msg)
+		}
+	}
+}
+
+func TestInvalidTags(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	long := strings.Repeat("a", maxTagLength+10)
+
+	if err := c.Tag("my app", "-lead", "ok.tag_1", "---", "héllo", long); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := c.tagsList(), "my_app,lead,ok.tag_1,h_llo,"+long[:maxTagLength]; got != want {
+		t.Fatalf("expected tags %q, got %q", want, got)
+	}
+
+	c.SetTags()
+	c.StrictTags = true
+
+	err := c.Tag("ok", "my app", "-lead")
+	if !errors.Is(err, ErrInvalidTag) || !strings.Contains(err.Error(), `"my app"`) {
+		t.Fatalf("expected ErrInvalidTag for the first invalid tag, got %v", err)
+	}
+
+	if got := c.tagsList(); got != "ok" {
+		t.Fatalf("expected only the valid tag kept, got %q", got)
+	}
+}
+
+func TestAdaptiveInterval(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.BufferSize = 10
+
+	interval := func(buffered int) time.Duration {
+		c.Lock()
+		defer c.Unlock()
+
+		c.buffer = make([]*entry, buffered)
+		defer func() { c.buffer = nil }()
+		return c.adaptiveInterval()
+	}
+
+	for _, tt := range []struct {
+		min, max time.Duration
+		buffered int
+		want     time.Duration
+	}{
+		{0, 0, 0, 30 * time.Second},
+		{0, 0, 10, time.Second},
+		{time.Second, 11 * time.Second, 0, 11 * time.Second},
+		{time.Second, 11 * time.Second, 5, 6 * time.Second},
+		{time.Second, 11 * time.Second, 10, time.Second},
+		{time.Second, 11 * time.Second, 20, time.Second},
+		{time.Minute, time.Second, 0, time.Minute},
+	} {
+		c.MinFlushInterval, c.MaxFlushInterval = tt.min, tt.max
+
+		if got := interval(tt.buffered); got != tt.want {
+			t.Fatalf("expected %v with %d buffered between %v and %v, got %v", tt.want, tt.buffered, tt.min, tt.max, got)
+		}
+	}
+}
+
+func TestFlushResponse(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(`{"response":"ok"}`))
+		zw.Close()
+	})
+	c := newTestClient(t, s)
+
+	if res, err := c.FlushResponse(); res != nil || err != nil {
+		t.Fatalf("expected no response with nothing to send, got %v %v", res, err)
+	}
+
+	c.Send(Message{"hello": "world"})
+
+	res, err := c.FlushResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != `{"response":"ok"}` || res.StatusCode != 200 {
+		t.Fatalf("expected the decoded response, got %d %q", res.StatusCode, body)
+	}
+
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Length") != "" {
+		t.Fatalf("expected encoding headers removed, got %v", res.Header)
+	}
+
+	if !res.Uncompressed || res.ContentLength != int64(len(body)) {
+		t.Fatalf("expected the decoded length, got %d", res.ContentLength)
+	}
+}
+
+func TestMessageField(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	c.Info("default", nil)
+	c.MessageField = "msg"
+
+	if c.MessageKey() != "msg" || c.With(Message{"a": 1}).MessageKey() != "msg" {
+		t.Fatal("expected the msg key for the client and its children")
+	}
+
+	c.Info("helper", Message{"a": 1})
+	c.With(Message{"b": 2}).Info("child", nil)
+	slog.New(c.SlogHandler(nil)).Info("slog")
+	c.WriteMessage([]byte("raw"))
+
+	msgs := buffered(t, c)
+	if len(msgs) != 5 {
+		t.Fatalf("expected 5 messages, got %d", len(msgs))
+	}
+
+	if msgs[0]["message"] != "default" {
+		t.Fatalf("expected the default message field, got %v", msgs[0])
+	}
+
+	for i, want := range []string{"helper", "child", "slog", "raw"} {
+		if msg := msgs[i+1]; msg["msg"] != want || msg["message"] != nil {
+			t.Fatalf("expected %q under msg, got %v", want, msg)
+		}
+	}
+}
+
+func TestSpoolReplayTags(t *testing.T) {
+	dir := t.TempDir()
+
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+	c.SpoolDir = dir
+
+	c.spool([]*entry{{data: []byte(`{"message":"billing"}`), tags: []string{"billing", "api"}, count: 1}})
+	c.spool([]*entry{{data: []byte(`{"message":"auth"}`), tags: []string{"auth"}, count: 1}})
+	c.spool([]*entry{{data: []byte(`{"message":"untagged"}`), count: 1}})
+
+	if files := spooled(dir); len(files) != 3 {
+		t.Fatalf("expected 3 spooled batches, got %d", len(files))
+	}
+
+	c.Tag("web")
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := map[string]string{}
+	for _, r := range s.received() {
+		tags[r.header.Get("X-Loggly-Tag")] = string(r.body)
+	}
+
+	if len(tags) != 3 ||
+		!strings.Contains(tags["web,api,billing"], `"message":"billing"`) ||
+		!strings.Contains(tags["web,auth"], `"message":"auth"`) ||
+		!strings.Contains(tags["web"], `"message":"untagged"`) {
+		t.Fatalf("expected a request per set of tags, got %v", tags)
+	}
+
+	long := strings.Repeat("a", maxTagLength-1)
+	many := []string{long + "1", long + "2", long + "3", long + "4"}
+
+	if c.spool([]*entry{{data: []byte(`{}`), tags: many, count: 1}}) != "" {
+		t.Fatal("expected batches with tags too long for a file name not spooled")
+	}
+}
+
+func TestCoerceNumbers(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.CoerceNumbers = true
+
+	msg := Message{
+		"status":  "200",
+		"ratio":   "-0.5",
+		"exp":     "1e3",
+		"zip":     "02134",
+		"padded":  " 42",
+		"mixed":   "42abc",
+		"word":    "true",
+		"empty":   "",
+		"number":  7,
+		"bool":    true,
+		"nested":  Message{"bytes": "1024", "name": "x"},
+		"missing": nil,
+	}
+	c.Send(msg)
+
+	c.NumericFields = []string{"status"}
+	c.Send(Message{"status": "404", "ratio": "0.5"})
+
+	msgs := buffered(t, c)
+
+	for k, v := range map[string]interface{}{
+		"status":  float64(200),
+		"ratio":   -0.5,
+		"exp":     float64(1000),
+		"zip":     "02134",
+		"padded":  " 42",
+		"mixed":   "42abc",
+		"word":    "true",
+		"empty":   "",
+		"number":  float64(7),
+		"bool":    true,
+		"missing": nil,
+	} {
+		if msgs[0][k] != v {
+			t.Fatalf("expected %q to be %#v, got %#v", k, v, msgs[0][k])
+		}
+	}
+
+	if nested := msgs[0]["nested"].(map[string]interface{}); nested["bytes"] != float64(1024) || nested["name"] != "x" {
+		t.Fatalf("expected nested numbers coerced, got %v", nested)
+	}
+
+	if msgs[1]["status"] != float64(404) || msgs[1]["ratio"] != "0.5" {
+		t.Fatalf("expected only NumericFields coerced, got %v", msgs[1])
+	}
+}
+
+func TestWriterFunc(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+
+	var out, added bytes.Buffer
+	c.Writer = &out
+	c.AddWriter(&added)
+	c.WriterFunc = func(msg Message) []byte {
+		return []byte(fmt.Sprintf("[%v] %v", msg["level"], msg["message"]))
+	}
+
+	c.Info("formatted", Message{"user": "tobi"})
+	c.Write([]byte("raw"))
+
+	if want := "[info] formatted\nraw"; out.String() != want || added.String() != want {
+		t.Fatalf("expected %q written, got %q and %q", want, out.String(), added.String())
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := s.only(t).body; !bytes.Contains(body, []byte(`"message":"formatted"`)) || !bytes.Contains(body, []byte(`"user":"tobi"`)) {
+		t.Fatalf("expected JSON sent to loggly, got %s", body)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	for _, tt := range []struct {
+		setup      func(*Client)
+		path, tags string
+		want       string
+	}{
+		{nil, "bulk", "", "https://logs-01.loggly.com/bulk/token"},
+		{nil, "inputs", "", "https://logs-01.loggly.com/inputs/token"},
+		{nil, "bulk", "a,b", "https://logs-01.loggly.com/bulk/token"},
+		{func(c *Client) { c.TagMode = TagModePath }, "bulk", "a,b", "https://logs-01.loggly.com/bulk/token/tag/a,b/"},
+		{func(c *Client) { c.TagMode = TagModePath }, "inputs", "", "https://logs-01.loggly.com/inputs/token"},
+		{WithRegion("eu"), "inputs", "", "https://logs-01.eu.loggly.com/inputs/token"},
+		{func(c *Client) { c.BaseURL = "http://relay:8080/" }, "bulk", "", "http://relay:8080/bulk/token"},
+		{func(c *Client) { c.BaseURL = "http://relay" }, "inputs", "", "http://relay/inputs/token"},
+		{func(c *Client) { c.BaseURL, c.TagMode = "http://relay", TagModePath }, "bulk", "web", "http://relay/bulk/token/tag/web/"},
+	} {
+		c := NewWithOptions("token", func(c *Client) {
+			c.DryRun = true
+			if tt.setup != nil {
+				tt.setup(c)
+			}
+		})
+
+		got, err := c.endpoint(tt.path, tt.tags)
+		c.Close()
+
+		if err != nil || got != tt.want {
+			t.Fatalf("expected %q for %s %q, got %q %v", tt.want, tt.path, tt.tags, got, err)
+		}
+	}
+}
+
+func TestSetTokenConcurrently(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Send(Message{"hello": "world"})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c.Flush()
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c.SetToken(fmt.Sprintf("token%d", i))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.SetToken("final")
+	c.Send(Message{"hello": "world"})
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := s.received()
+	for _, r := range requests {
+		if !strings.HasPrefix(r.path, "/bulk/token") && r.path != "/bulk/final" {
+			t.Fatalf("unexpected path %q", r.path)
+		}
+	}
+
+	if last := requests[len(requests)-1]; last.path != "/bulk/final" {
+		t.Fatalf("expected the last flush to use the final token, got %q", last.path)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	var mu sync.Mutex
+	hung := false
+
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hang := !hung
+		hung = true
+		mu.Unlock()
+
+		if hang {
+			<-r.Context().Done()
+		}
+	})
+
+	errs := make(chan error, 10)
+	c := newTestClient(t, s)
+	c.FlushTimeout = 50 * time.Millisecond
+	c.MaxRetries = 0
+	c.OnError = func(err error) { errs <- err }
+
+	c.Send(Message{"hello": "world"})
+	c.signal()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the hung flush to time out")
+	}
+
+	if n := c.Pending(); n != 1 {
+		t.Fatalf("expected the message requeued, got %d pending", n)
+	}
+
+	c.signal()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().MessagesSent != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the flusher to recover")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMethodAndContentType(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+
+	c.Send(Message{"hello": "world"})
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Method = http.MethodPut
+	c.ContentType = "application/x-ndjson"
+
+	c.Send(Message{"hello": "world"})
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := s.received()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+
+	if r := requests[0]; r.method != "POST" || r.header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("expected the defaults, got %s %q", r.method, r.header.Get("Content-Type"))
+	}
+
+	if r := requests[1]; r.method != "PUT" || r.header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected PUT application/x-ndjson, got %s %q", r.method, r.header.Get("Content-Type"))
+	}
+
+	for _, setup := range []func(){
+		func() { c.Method, c.ContentType = http.MethodGet, "" },
+		func() { c.Method, c.ContentType = "", "not a type;;" },
+	} {
+		setup()
+
+		if err := c.Validate(); !errors.Is(err, ErrInvalidRequest) {
+			t.Fatalf("expected ErrInvalidRequest, got %v", err)
+		}
+	}
+
+	c.Send(Message{"hello": "world"})
+	if err := c.Flush(); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected the flush rejected, got %v", err)
+	}
+
+	if n := len(s.received()); n != 2 {
+		t.Fatalf("expected no request for an invalid content type, got %d", n-2)
+	}
+
+	if n := c.Pending(); n != 1 {
+		t.Fatalf("expected the message kept, got %d pending", n)
+	}
+
+	c.ContentType = ""
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(s.received()); n != 3 || c.Pending() != 0 {
+		t.Fatalf("expected the kept message sent once fixed, got %d requests", n)
+	}
+}
+
+func TestFlushNCountsSplitBatches(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if bytes.Count(body, nl) > 0 || bytes.Contains(body, []byte("huge")) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	})
+	c := newTestClient(t, s)
+
+	for i := 0; i < 4; i++ {
+		c.Send(Message{"n": i})
+	}
+
+	if n, err := c.FlushN(); n != 4 || err != nil {
+		t.Fatalf("expected 4 messages delivered in halves, got %d %v", n, err)
+	}
+
+	c.Send(Message{"n": 4})
+	c.Send(Message{"n": "huge"})
+	c.Send(Message{"n": 5})
+
+	n, err := c.FlushN()
+	if n != 2 || err == nil {
+		t.Fatalf("expected 2 messages delivered and an error, got %d %v", n, err)
+	}
+
+	if s := c.Stats(); s.MessagesDropped != 1 {
+		t.Fatalf("expected the huge message dropped, got %+v", s)
+	}
+}
+
+func TestStartupEventAndClientVersion(t *testing.T) {
+	s := newServer(t, nil)
+	c := NewWithOptions("token", func(c *Client) {
+		c.Endpoint = s.URL + "/bulk/token"
+		c.FlushInterval = time.Hour
+		c.IncludeClientVersion = true
+	}, WithStartupEvent())
+	defer c.Close()
+
+	c.Send(Message{"hello": "world"})
+
+	msgs := buffered(t, c)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+
+	if msg := msgs[0]; msg["loggly_client"] != "started" || msg["version"] != Version {
+		t.Fatalf("expected the startup event, got %v", msg)
+	}
+
+	if msg := msgs[1]; msg["_loggly_client_version"] != Version || msg["hello"] != "world" {
+		t.Fatalf("expected the client version, got %v", msg)
+	}
+
+	c = NewWithOptions("token", func(c *Client) { c.DryRun = true })
+	defer c.Close()
+
+	c.Send(Message{"hello": "world"})
+
+	if msgs := buffered(t, c); len(msgs) != 1 || msgs[0]["_loggly_client_version"] != nil {
+		t.Fatalf("expected neither by default, got %v", msgs)
+	}
+}
+
+func TestSendNil(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+	c.SetDefaults(Message{"hostname": "web-1", "service": "billing"})
+
+	if err := c.Send(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := buffered(t, c)[0]
+	if len(msg) != 3 || msg["hostname"] != "web-1" || msg["service"] != "billing" || msg["timestamp"] == nil {
+		t.Fatalf("expected the defaults and timestamp alone, got %v", msg)
+	}
+}
+
+func TestOnErrorCloses(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	closed := make(chan error, 1)
+	c := newTestClient(t, s)
+	c.OnError = func(err error) {
+		closed <- c.Close()
+	}
+
+	c.Send(Message{"hello": "world"})
+	c.signal()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close called by OnError to return")
+	}
+}
+
+func TestSendNowMirrors(t *testing.T) {
+	var out, added bytes.Buffer
+	c := NewWithOptions("token", func(c *Client) {
+		c.DryRun = true
+		c.Writer = &out
+	})
+	defer c.Close()
+	c.AddWriter(&added)
+
+	if err := c.SendNow(Message{"hello": "world"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"hello":"world"`) || out.String() != added.String() {
+		t.Fatalf("expected the message written, got %q and %q", out.String(), added.String())
+	}
+
+	c.WriterFunc = func(msg Message) []byte {
+		return []byte(fmt.Sprintf("%v", msg["hello"]))
+	}
+	out.Reset()
+
+	c.SendNow(Message{"hello": "formatted"})
+
+	if out.String() != "formatted\n" {
+		t.Fatalf("expected the message formatted by WriterFunc, got %q", out.String())
+	}
+
+	if s := c.Stats(); s.MessagesDryRun != 2 {
+		t.Fatalf("expected 2 dry run messages, got %+v", s)
+	}
+}
+
+func TestWriteMessageLargeIntegers(t *testing.T) {
+	c := newTestClient(t, newServer(t, nil))
+
+	c.WriteMessage([]byte(`{"id":9007199254740993,"ratio":0.25}`))
+	c.WriteMessage([]byte(`{"id":1} trailing`))
+
+	c.Lock()
+	first, second := string(c.buffer[0].bytes()), string(c.buffer[1].bytes())
+	c.Unlock()
+
+	if !strings.Contains(first, `"id":9007199254740993`) || !strings.Contains(first, `"ratio":0.25`) {
+		t.Fatalf("expected the numbers kept as written, got %s", first)
+	}
+
+	if !strings.Contains(second, `"message":"{\"id\":1} trailing"`) {
+		t.Fatalf("expected trailing data sent as the message, got %s", second)
+	}
+}
+
+func TestSendTaggedGroups(t *testing.T) {
+	s := newServer(t, nil)
+	c := newTestClient(t, s)
+	c.Tag("web")
+
+	c.SendTagged(Message{"n": 1}, "checkout")
+	c.SendTagged(Message{"n": 2}, "auth")
+	c.SendTagged(Message{"n": 3}, "web", "checkout")
+	c.Send(Message{"n": 4})
+	c.SendTagged(Message{"n": 5}, "web")
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := s.received()
+	if len(requests) != 3 {
+		t.Fatalf("expected a request per set of tags, got %d", len(requests))
+	}
+
+	for i, want := range []struct{ tags, ns string }{
+		{"web,checkout", "1,3"},
+		{"web,auth", "2"},
+		{"web", "4,5"},
+	} {
+		r := requests[i]
+		if tags := r.header.Get("X-Loggly-Tag"); tags != want.tags {
+			t.Fatalf("expected X-Loggly-Tag %q, got %q", want.tags, tags)
+		}
+
+		var ns []string
+		for _, line := range strings.Split(string(r.body), "\n") {
+			var msg Message
+			Unmarshal([]byte(line), &msg)
+			ns = append(ns, fmt.Sprint(msg["n"]))
+		}
+
+		if got := strings.Join(ns, ","); got != want.ns {
+			t.Fatalf("expected messages %s tagged %q, got %s", want.ns, want.tags, got)
+		}
+	}
+}
+
+func TestSetTokenFromEmpty(t *testing.T) {
+	c := NewWithOptions("", func(c *Client) { c.DryRun = true })
+	defer c.Close()
+
+	c.SetToken("abc")
+
+	if c.Endpoint != "https://logs-01.loggly.com/bulk/abc" {
+		t.Fatalf("expected the token in the end-point, got %q", c.Endpoint)
+	}
+
+	c = NewWithOptions("", WithRegion("eu"), func(c *Client) { c.DryRun = true })
+	defer c.Close()
+
+	c.SetToken("abc")
+	c.SetToken("def")
+
+	if c.Endpoint != "https://logs-01.eu.loggly.com/bulk/def" {
+		t.Fatalf("expected the eu end-point with the new token, got %q", c.Endpoint)
+	}
+
+	c.Endpoint = "http://relay/custom/def"
+	c.SetToken("ghi")
+
+	if c.Endpoint != "http://relay/custom/ghi" {
+		t.Fatalf("expected a custom end-point ending with the token updated, got %q", c.Endpoint)
+	}
+}
@@ -0,0 +1,20 @@
+// Package logglyotel adds the trace and span IDs of OpenTelemetry spans
+// carried by a context to messages sent with SendContext.
+//
+//	c.Trace = logglyotel.Trace
+//	c.SendContext(ctx, loggly.Message{"message": "hello"})
+package logglyotel
+
+import "go.opentelemetry.io/otel/trace"
+import "context"
+
+// Trace returns the IDs of the OpenTelemetry span in `ctx`,
+// for use as loggly.Client.Trace.
+func Trace(ctx context.Context) (traceID, spanID string, ok bool) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", "", false
+	}
+
+	return sc.TraceID().String(), sc.SpanID().String(), true
+}
@@ -0,0 +1,51 @@
+package logglyotel
+
+import "go.opentelemetry.io/otel/trace"
+import "github.com/segmentio/go-loggly"
+import . "encoding/json"
+import "context"
+import "testing"
+import "bytes"
+
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := loggly.NewWithOptions("token", func(c *loggly.Client) {
+		c.Trace = Trace
+		c.Writer = &buf
+		c.DryRun = true
+	})
+	defer c.Close()
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	if err := c.SendContext(ctx, loggly.Message{"message": "traced"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SendContext(context.Background(), loggly.Message{"message": "untraced"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte{'\n'})
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(lines))
+	}
+
+	var traced, untraced loggly.Message
+	Unmarshal(lines[0], &traced)
+	Unmarshal(lines[1], &untraced)
+
+	if traced["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || traced["span_id"] != "00f067aa0ba902b7" {
+		t.Fatalf("expected the span IDs, got %v", traced)
+	}
+
+	if _, ok := untraced["trace_id"]; ok {
+		t.Fatalf("expected no IDs without a span, got %v", untraced)
+	}
+}
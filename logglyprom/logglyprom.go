@@ -0,0 +1,72 @@
+// Package logglyprom exports the Stats of a loggly client, such as
+// buffered, sent and dropped messages, as Prometheus metrics.
+//
+//	prometheus.MustRegister(logglyprom.NewCollector(c))
+package logglyprom
+
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/segmentio/go-loggly"
+
+var (
+	buffered = prometheus.NewDesc(
+		"loggly_buffered_messages",
+		"Messages currently buffered.",
+		nil, nil)
+
+	messagesSent = prometheus.NewDesc(
+		"loggly_messages_sent_total",
+		"Messages delivered.",
+		nil, nil)
+
+	batchesSent = prometheus.NewDesc(
+		"loggly_batches_sent_total",
+		"Batches delivered.",
+		nil, nil)
+
+	flushErrors = prometheus.NewDesc(
+		"loggly_flush_errors_total",
+		"Failed flush attempts.",
+		nil, nil)
+
+	messagesDropped = prometheus.NewDesc(
+		"loggly_messages_dropped_total",
+		"Messages discarded without delivery.",
+		nil, nil)
+
+	bytesSent = prometheus.NewDesc(
+		"loggly_bytes_sent_total",
+		"Bytes delivered.",
+		nil, nil)
+)
+
+// Collector of a client's statistics.
+type collector struct {
+	client *loggly.Client
+}
+
+// NewCollector returns a collector of `c`'s statistics.
+func NewCollector(c *loggly.Client) prometheus.Collector {
+	return &collector{client: c}
+}
+
+// Describe implements prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- buffered
+	ch <- messagesSent
+	ch <- batchesSent
+	ch <- flushErrors
+	ch <- messagesDropped
+	ch <- bytesSent
+}
+
+// Collect implements prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.client.Stats()
+
+	ch <- prometheus.MustNewConstMetric(buffered, prometheus.GaugeValue, float64(s.Buffered))
+	ch <- prometheus.MustNewConstMetric(messagesSent, prometheus.CounterValue, float64(s.MessagesSent))
+	ch <- prometheus.MustNewConstMetric(batchesSent, prometheus.CounterValue, float64(s.BatchesSent))
+	ch <- prometheus.MustNewConstMetric(flushErrors, prometheus.CounterValue, float64(s.FlushErrors))
+	ch <- prometheus.MustNewConstMetric(messagesDropped, prometheus.CounterValue, float64(s.MessagesDropped))
+	ch <- prometheus.MustNewConstMetric(bytesSent, prometheus.CounterValue, float64(s.BytesSent))
+}
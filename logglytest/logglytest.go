@@ -0,0 +1,78 @@
+// Package logglytest provides a loggly.Logger recording
+// messages in memory for use in tests.
+package logglytest
+
+import "github.com/segmentio/go-loggly"
+import "sync"
+
+var _ loggly.Logger = (*MemoryLogger)(nil)
+
+// MemoryLogger records sent messages and written data.
+// The zero value is ready to use.
+type MemoryLogger struct {
+	messages []loggly.Message
+	written  [][]byte
+	flushes  int
+	sync.Mutex
+}
+
+// Send records a copy of `msg`.
+func (m *MemoryLogger) Send(msg loggly.Message) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.messages = append(m.messages, loggly.MergedCopy(msg))
+	return nil
+}
+
+// Write records a copy of `b`.
+func (m *MemoryLogger) Write(b []byte) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.written = append(m.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// Flush records the flush.
+func (m *MemoryLogger) Flush() error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.flushes++
+	return nil
+}
+
+// Messages returns the sent messages.
+func (m *MemoryLogger) Messages() []loggly.Message {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]loggly.Message(nil), m.messages...)
+}
+
+// Written returns the written data.
+func (m *MemoryLogger) Written() [][]byte {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([][]byte(nil), m.written...)
+}
+
+// Flushes returns the number of flushes.
+func (m *MemoryLogger) Flushes() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.flushes
+}
+
+// Reset discards everything recorded.
+func (m *MemoryLogger) Reset() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.messages = nil
+	m.written = nil
+	m.flushes = 0
+}
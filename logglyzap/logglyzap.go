@@ -0,0 +1,102 @@
+// Package logglyzap provides a zap core buffering entries with a loggly
+// client, mapping zap levels to loggly ones and flushing entries above
+// the error level at once.
+//
+//	logger := zap.New(logglyzap.NewCore(c, zapcore.InfoLevel))
+package logglyzap
+
+import "go.uber.org/zap/zapcore"
+import "github.com/segmentio/go-loggly"
+
+// Core of a zap logger backed by a loggly client.
+type core struct {
+	zapcore.LevelEnabler
+	client *loggly.Client
+	fields []zapcore.Field
+}
+
+// NewCore returns a zap core buffering entries enabled by `enab`
+// with `c`, which also filters them by its own level.
+func NewCore(c *loggly.Client, enab zapcore.LevelEnabler) zapcore.Core {
+	return &core{LevelEnabler: enab, client: c}
+}
+
+// With implements zapcore.Core.
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	child := *c
+	child.fields = append(c.fields[:len(c.fields):len(c.fields)], fields...)
+	return &child
+}
+
+// Check implements zapcore.Core.
+func (c *core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+
+	return ce
+}
+
+// Write implements zapcore.Core.
+func (c *core) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	msg := loggly.Message(enc.Fields)
+	level := Level(ent.Level)
+
+	msg["level"] = level.String()
+	msg[c.client.MessageKey()] = ent.Message
+	msg[c.client.TimestampKey()] = ent.Time
+
+	if ent.LoggerName != "" {
+		msg["logger"] = ent.LoggerName
+	}
+
+	if ent.Caller.Defined {
+		msg["caller"] = ent.Caller.TrimmedPath()
+	}
+
+	if ent.Stack != "" {
+		msg["stack"] = ent.Stack
+	}
+
+	if err := c.client.SendLevel(level, msg); err != nil {
+		return err
+	}
+
+	// Flush entries after which the process may panic or exit.
+	if ent.Level > zapcore.ErrorLevel {
+		return c.client.Flush()
+	}
+
+	return nil
+}
+
+// Sync implements zapcore.Core, flushing the client.
+func (c *core) Sync() error {
+	return c.client.Flush()
+}
+
+// Level returns the loggly level of a zap level.
+func Level(level zapcore.Level) loggly.Level {
+	switch {
+	case level < zapcore.InfoLevel:
+		return loggly.DEBUG
+	case level < zapcore.WarnLevel:
+		return loggly.INFO
+	case level < zapcore.ErrorLevel:
+		return loggly.WARNING
+	case level < zapcore.DPanicLevel:
+		return loggly.ERROR
+	default:
+		return loggly.FATAL
+	}
+}
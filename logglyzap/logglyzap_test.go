@@ -0,0 +1,91 @@
+package logglyzap
+
+import "github.com/segmentio/go-loggly"
+import "go.uber.org/zap/zapcore"
+import "net/http/httptest"
+import . "encoding/json"
+import "go.uber.org/zap"
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "testing"
+import "sync"
+import "time"
+
+func TestCore(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(b))
+	}))
+	defer s.Close()
+
+	c := loggly.NewWithOptions("token", func(c *loggly.Client) {
+		c.Endpoint = s.URL + "/bulk/token"
+		c.MessageField = "msg"
+		c.TimestampField = "ts"
+	})
+	defer c.Close()
+	c.SetFlushInterval(time.Hour)
+
+	logger := zap.New(NewCore(c.With(loggly.Message{"request": "42"}), zapcore.InfoLevel)).
+		Named("api").
+		With(zap.String("service", "billing"))
+
+	logger.Debug("dropped")
+	logger.Info("charged", zap.Int("cents", 250))
+
+	mu.Lock()
+	n := len(bodies)
+	mu.Unlock()
+
+	if n != 0 {
+		t.Fatalf("expected info entries to stay buffered, got %d requests", n)
+	}
+
+	// Entries above ErrorLevel are flushed at once.
+	logger.DPanic("inconsistent")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(bodies))
+	}
+
+	lines := strings.Split(strings.TrimSpace(bodies[0]), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 messages, got %q", bodies[0])
+	}
+
+	var msg map[string]interface{}
+	if err := Unmarshal([]byte(lines[0]), &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"msg":     "charged",
+		"level":   "info",
+		"logger":  "api",
+		"service": "billing",
+		"request": "42",
+		"cents":   float64(250),
+	} {
+		if msg[k] != v {
+			t.Fatalf("expected %q to be %v, got %v", k, v, msg)
+		}
+	}
+
+	if _, ok := msg["ts"]; !ok {
+		t.Fatalf("expected the timestamp under ts, got %v", msg)
+	}
+
+	if _, ok := msg["message"]; ok {
+		t.Fatalf("expected no message field, got %v", msg)
+	}
+}
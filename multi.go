@@ -0,0 +1,75 @@
+package loggly
+
+import "errors"
+import "io"
+
+// MultiClient fans messages out to several clients, such as clients
+// with different tokens. Each client keeps its own buffer and settings.
+type MultiClient struct {
+	clients []*Client
+}
+
+var _ Logger = (*MultiClient)(nil)
+var _ io.WriteCloser = (*MultiClient)(nil)
+
+// Tee returns a MultiClient sending to each of `clients`.
+func Tee(clients ...*Client) *MultiClient {
+	return &MultiClient{clients: append([]*Client(nil), clients...)}
+}
+
+// Send buffers `msg` with each client, returning their errors joined.
+func (m *MultiClient) Send(msg Message) error {
+	return m.each(func(c *Client) error {
+		return c.Send(msg)
+	})
+}
+
+// SendLevel buffers `msg` at `level` with each client,
+// returning their errors joined.
+func (m *MultiClient) SendLevel(level Level, msg Message) error {
+	return m.each(func(c *Client) error {
+		return c.SendLevel(level, msg)
+	})
+}
+
+// Write writes raw data to each client, returning their errors joined.
+// The length of `b` is returned unless every client fails.
+func (m *MultiClient) Write(b []byte) (int, error) {
+	failed := 0
+	err := m.each(func(c *Client) error {
+		_, err := c.Write(b)
+		if err != nil {
+			failed++
+		}
+		return err
+	})
+
+	if failed > 0 && failed == len(m.clients) {
+		return 0, err
+	}
+
+	return len(b), err
+}
+
+// Flush flushes each client, returning their errors joined.
+func (m *MultiClient) Flush() error {
+	return m.each((*Client).Flush)
+}
+
+// Close closes each client, returning their errors joined.
+func (m *MultiClient) Close() error {
+	return m.each((*Client).Close)
+}
+
+// Call `fn` with each client, joining the errors.
+func (m *MultiClient) each(fn func(*Client) error) error {
+	var errs []error
+
+	for _, c := range m.clients {
+		if err := fn(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package loggly
+
+import "net/http"
+import "strings"
+import "time"
+
+// Option configures a client before its flusher starts.
+type Option func(*Client)
+
+// NewWithOptions returns a new loggly client with the given `token`,
+// applying `opts` before the flusher starts so they never race with it.
+func NewWithOptions(token string, opts ...Option) *Client {
+	c, _ := newClient(token, "us", nil)
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.StartupEvent {
+		c.started()
+	}
+
+	go c.start()
+
+	return c
+}
+
+// WithTags adds `tags` to the client.
+func WithTags(tags ...string) Option {
+	return func(c *Client) {
+		c.Tag(tags...)
+	}
+}
+
+// WithBufferSize sets BufferSize.
+func WithBufferSize(n int) Option {
+	return func(c *Client) {
+		c.BufferSize = n
+	}
+}
+
+// WithFlushInterval sets FlushInterval.
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *Client) {
+		c.FlushInterval = d
+	}
+}
+
+// WithLevel sets Level.
+func WithLevel(level Level) Option {
+	return func(c *Client) {
+		c.Level = level
+	}
+}
+
+// WithHTTPClient sets HTTPClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.HTTPClient = client
+	}
+}
+
+// WithRegion sends to `region`, either "us" or "eu" in any case. An
+// unknown region leaves the client without an end-point, reporting it
+// from Validate and flushes.
+func WithRegion(region string) Option {
+	return func(c *Client) {
+		endpoint, err := endpointFor(region, "bulk", c.Token)
+		if err != nil {
+			debug("error: %v", err)
+		}
+
+		c.Region, c.Endpoint, c.invalid = strings.ToLower(region), endpoint, err
+	}
+}
+
+// WithoutHostname removes the "hostname" default.
+func WithoutHostname() Option {
+	return func(c *Client) {
+		delete(c.Defaults, "hostname")
+	}
+}
+
+// WithStartupEvent sets StartupEvent.
+func WithStartupEvent() Option {
+	return func(c *Client) {
+		c.StartupEvent = true
+	}
+}
@@ -0,0 +1,57 @@
+package loggly
+
+import "sync"
+import "time"
+
+// Token bucket refilled continuously, holding at most
+// one second of tokens and no less than one.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+// Take a token at `rate` per second, reporting whether one was available.
+func (b *bucket) take(rate float64) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	b.last = now
+
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Decide whether a message at `level` is within RateLimit.
+func (c *Client) allow(level Level) bool {
+	if c.RateLimit <= 0 {
+		return true
+	}
+
+	for _, l := range c.RateLimitExempt {
+		if l == level {
+			return true
+		}
+	}
+
+	return c.limiter.take(c.RateLimit)
+}
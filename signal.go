@@ -0,0 +1,52 @@
+package loggly
+
+import "os/signal"
+import "syscall"
+import "sync"
+import "os"
+
+// FlushOnSignal flushes synchronously when the process receives one of
+// `signals`, SIGINT and SIGTERM by default, for example during the grace
+// period between SIGTERM and SIGKILL when a container is stopped. Other
+// handlers installed with signal.Notify keep receiving the signals.
+//
+// After the flush, handling stops and the signal is raised again so that
+// its default action, such as exiting, takes place. Programs handling the
+// signal themselves therefore receive it twice. The returned func stops
+// handling without raising anything.
+func (c *Client) FlushOnSignal(signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, signals...)
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+
+	go func() {
+		select {
+		case sig := <-ch:
+			debug("received %v, flushing", sig)
+			if err := c.Flush(); err != nil {
+				debug("error: %v", err)
+			}
+
+			stop()
+
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,222 @@
+package loggly
+
+import "log/slog"
+import "runtime"
+import "context"
+import "time"
+import "fmt"
+
+// SlogHandler returns a slog.Handler sending records through the client.
+// Records below the client's level, or below `opts.Level` when set, are
+// dropped. Groups are nested as sub-messages. `opts` may be nil. With
+// AddSource the source is added as "caller", so that it does not replace
+// the client's Source.
+func (c *Client) SlogHandler(opts *slog.HandlerOptions) slog.Handler {
+	h := &slogHandler{client: c, attrs: Message{}}
+
+	if opts != nil {
+		h.opts = *opts
+	}
+
+	return h
+}
+
+// slog.Handler backed by a client.
+type slogHandler struct {
+	client *Client
+	opts   slog.HandlerOptions
+	attrs  Message
+	groups []string
+}
+
+// Enabled implements slog.Handler.
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if h.opts.Level != nil && level < h.opts.Level.Level() {
+		return false
+	}
+
+	return slogLevel(level) >= h.client.base().Level
+}
+
+// Handle implements slog.Handler.
+func (h *slogHandler) Handle(_ context.Context, r slog.Record) error {
+	msg := clone(h.attrs)
+
+	if r.NumAttrs() > 0 {
+		group := nest(msg, h.groups)
+		r.Attrs(func(a slog.Attr) bool {
+			h.add(group, h.groups, a)
+			return true
+		})
+	}
+
+	if !r.Time.IsZero() {
+		h.builtin(msg, slog.Time(slog.TimeKey, r.Time))
+	}
+
+	level := slogLevel(r.Level)
+	h.builtin(msg, slog.Any(slog.LevelKey, r.Level))
+	h.builtin(msg, slog.String(slog.MessageKey, r.Message))
+
+	if h.opts.AddSource && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		h.builtin(msg, slog.Any(slog.SourceKey, &slog.Source{
+			Function: frame.Function,
+			File:     frame.File,
+			Line:     frame.Line,
+		}))
+	}
+
+	return h.client.SendLevel(level, msg)
+}
+
+// Add built-in attribute `a` to `msg` after ReplaceAttr, under the
+// client's field for its key unless renamed: the timestamp and message
+// fields, "level", and "caller" for the source, leaving "source" to
+// the client's Source.
+func (h *slogHandler) builtin(msg Message, a slog.Attr) {
+	key := a.Key
+
+	if h.opts.ReplaceAttr != nil {
+		a = h.opts.ReplaceAttr(nil, a)
+		a.Value = a.Value.Resolve()
+	}
+
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Key != key {
+		msg[a.Key] = a.Value.Any()
+		return
+	}
+
+	r := h.client.base()
+	v := a.Value.Any()
+
+	switch t := v.(type) {
+	case time.Time:
+		v = r.timestamp(t)
+	case slog.Level:
+		v = slogLevel(t).String()
+	case *slog.Source:
+		v = fmt.Sprintf("%s:%d", t.File, t.Line)
+	}
+
+	switch key {
+	case slog.TimeKey:
+		key = r.timestampField()
+	case slog.MessageKey:
+		key = r.messageField()
+	case slog.SourceKey:
+		key = "caller"
+	}
+
+	msg[key] = v
+}
+
+// WithAttrs implements slog.Handler.
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	child := *h
+	child.attrs = clone(h.attrs)
+
+	group := nest(child.attrs, h.groups)
+	for _, a := range attrs {
+		child.add(group, h.groups, a)
+	}
+
+	return &child
+}
+
+// WithGroup implements slog.Handler.
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	child := *h
+	child.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+
+	return &child
+}
+
+// Add attribute `a` to `msg`, nesting groups.
+func (h *slogHandler) add(msg Message, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+
+	if a.Value.Kind() != slog.KindGroup && h.opts.ReplaceAttr != nil {
+		a = h.opts.ReplaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() != slog.KindGroup {
+		msg[a.Key] = a.Value.Any()
+		return
+	}
+
+	attrs := a.Value.Group()
+	if len(attrs) == 0 {
+		return
+	}
+
+	if a.Key != "" {
+		msg = nest(msg, []string{a.Key})
+		groups = append(groups[:len(groups):len(groups)], a.Key)
+	}
+
+	for _, ga := range attrs {
+		h.add(msg, groups, ga)
+	}
+}
+
+// Map a slog level to a loggly level.
+func slogLevel(level slog.Level) Level {
+	switch {
+	case level < slog.LevelInfo:
+		return DEBUG
+	case level < slog.LevelWarn:
+		return INFO
+	case level < slog.LevelError:
+		return WARNING
+	case level < slog.LevelError+4:
+		return ERROR
+	default:
+		return FATAL
+	}
+}
+
+// Return the sub-message of `msg` at the `groups` path, creating it.
+func nest(msg Message, groups []string) Message {
+	for _, name := range groups {
+		sub, ok := msg[name].(Message)
+		if !ok {
+			sub = Message{}
+			msg[name] = sub
+		}
+		msg = sub
+	}
+
+	return msg
+}
+
+// Deep copy `msg` and its sub-messages.
+func clone(msg Message) Message {
+	c := make(Message, len(msg))
+
+	for k, v := range msg {
+		if sub, ok := v.(Message); ok {
+			v = clone(sub)
+		}
+		c[k] = v
+	}
+
+	return c
+}
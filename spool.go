@@ -0,0 +1,167 @@
+package loggly
+
+import "io/ioutil"
+import "context"
+import "bytes"
+import "path/filepath"
+import "strings"
+import "sort"
+import "time"
+import "fmt"
+import "os"
+
+// Suffix of spooled batch files.
+const spoolExt = ".batch"
+
+// Longest spooled batch file name, the common limit of 255
+// bytes less the suffix of temporary files.
+const maxSpoolName = 251
+
+// Separates the time of a spooled batch file name from the tags
+// of its messages, "+" being invalid in tags.
+const spoolTagSep = "+"
+
+// Write `batch`, whose messages share the same tags, to the spool,
+// returning its file name or "" when not spooled. The tags are kept
+// in the file name.
+func (c *Client) spool(batch []*entry) string {
+	if c.SpoolDir == "" {
+		return ""
+	}
+
+	name := fmt.Sprintf("%020d", time.Now().UnixNano())
+	if tags := tagKey(batch[0].tags); tags != "" {
+		name += spoolTagSep + tags
+	}
+	name += spoolExt
+
+	if len(name) > maxSpoolName {
+		debug("tags too long, not spooling %d messages", len(batch))
+		return ""
+	}
+
+	lines := make([][]byte, len(batch))
+	for i, e := range batch {
+		lines[i] = e.bytes()
+	}
+	data := bytes.Join(lines, nl)
+
+	if c.MaxSpoolBytes > 0 && spoolSize(c.SpoolDir)+int64(len(data)) > c.MaxSpoolBytes {
+		debug("spool full, not spooling %d messages", len(batch))
+		return ""
+	}
+
+	if err := os.MkdirAll(c.SpoolDir, 0700); err != nil {
+		debug("error: %v", err)
+		return ""
+	}
+
+	// write then rename so partial writes are never replayed
+	file := filepath.Join(c.SpoolDir, name)
+	tmp := file + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		debug("error: %v", err)
+		os.Remove(tmp)
+		return ""
+	}
+
+	if err := os.Rename(tmp, file); err != nil {
+		debug("error: %v", err)
+		os.Remove(tmp)
+		return ""
+	}
+
+	debug("spooled %d messages to %s", len(batch), file)
+	return file
+}
+
+// Remove spooled `file`, if any.
+func (c *Client) unspool(file string) {
+	if file == "" {
+		return
+	}
+
+	if err := os.Remove(file); err != nil {
+		debug("error: %v", err)
+	}
+}
+
+// Deliver spooled batches, oldest first. Stops at the
+// first transient failure, leaving the rest spooled.
+func (c *Client) replay(ctx context.Context) error {
+	for _, file := range spooled(c.SpoolDir) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			debug("error: %v", err)
+			continue
+		}
+
+		tags := spooledTags(file)
+
+		var batch []*entry
+		for _, line := range bytes.Split(data, nl) {
+			if len(line) > 0 {
+				batch = append(batch, &entry{data: line, tags: tags, count: 1})
+			}
+		}
+
+		debug("replaying %d messages from %s", len(batch), file)
+
+		err = c.deliver(ctx, batch)
+		if err != nil && (ctx.Err() != nil || retryable(err)) {
+			return err
+		}
+
+		if err != nil {
+			c.stats.messagesDropped.Add(uint64(len(batch)))
+		}
+
+		c.unspool(file)
+	}
+
+	return nil
+}
+
+// Return the spooled batch files in `dir`, oldest first.
+func spooled(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == spoolExt {
+			names = append(names, filepath.Join(dir, f.Name()))
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Return the tags kept in the name of spooled batch `file`.
+func spooledTags(file string) []string {
+	name := strings.TrimSuffix(filepath.Base(file), spoolExt)
+
+	i := strings.Index(name, spoolTagSep)
+	if i < 0 {
+		return nil
+	}
+
+	return strings.Split(name[i+len(spoolTagSep):], ",")
+}
+
+// Return the total size of the spooled batches in `dir`.
+func spoolSize(dir string) int64 {
+	var n int64
+
+	for _, file := range spooled(dir) {
+		if info, err := os.Stat(file); err == nil {
+			n += info.Size()
+		}
+	}
+
+	return n
+}
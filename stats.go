@@ -0,0 +1,120 @@
+package loggly
+
+import "sync/atomic"
+
+// Stats of the client's delivery.
+type Stats struct {
+	// Messages delivered.
+	MessagesSent uint64
+
+	// Batches delivered.
+	BatchesSent uint64
+
+	// Failed flush attempts.
+	FlushErrors uint64
+
+	// Messages discarded without delivery.
+	MessagesDropped uint64
+
+	// Bytes delivered.
+	BytesSent uint64
+
+	// Messages discarded by sampling.
+	MessagesSampledOut uint64
+
+	// Messages discarded by the rate limit.
+	MessagesRateLimited uint64
+
+	// Messages flushed in DryRun mode, not sent.
+	MessagesDryRun uint64
+
+	// Background flushes skipped as there was nothing to send.
+	EmptyFlushesSkipped uint64
+
+	// Messages currently buffered.
+	Buffered uint64
+
+	// Bytes of the messages currently buffered.
+	BufferedBytes uint64
+
+	// State of the circuit breaker.
+	BreakerState BreakerState
+}
+
+// Counters backing Stats.
+type counters struct {
+	messagesSent    atomic.Uint64
+	batchesSent     atomic.Uint64
+	flushErrors     atomic.Uint64
+	messagesDropped atomic.Uint64
+	bytesSent       atomic.Uint64
+	sampledOut      atomic.Uint64
+	rateLimited     atomic.Uint64
+	dryRun          atomic.Uint64
+	emptySkipped    atomic.Uint64
+	buffered        atomic.Uint64
+	bufferedBytes   atomic.Uint64
+}
+
+// Zero the counters.
+func (s *counters) reset() {
+	s.messagesSent.Store(0)
+	s.batchesSent.Store(0)
+	s.flushErrors.Store(0)
+	s.messagesDropped.Store(0)
+	s.bytesSent.Store(0)
+	s.sampledOut.Store(0)
+	s.rateLimited.Store(0)
+	s.dryRun.Store(0)
+	s.emptySkipped.Store(0)
+	s.buffered.Store(0)
+	s.bufferedBytes.Store(0)
+}
+
+// Stats returns a snapshot of the delivery statistics.
+func (c *Client) Stats() Stats {
+	if c.root != nil {
+		return c.root.Stats()
+	}
+
+	return Stats{
+		MessagesSent:        c.stats.messagesSent.Load(),
+		BatchesSent:         c.stats.batchesSent.Load(),
+		FlushErrors:         c.stats.flushErrors.Load(),
+		MessagesDropped:     c.stats.messagesDropped.Load(),
+		BytesSent:           c.stats.bytesSent.Load(),
+		MessagesSampledOut:  c.stats.sampledOut.Load(),
+		MessagesRateLimited: c.stats.rateLimited.Load(),
+		MessagesDryRun:      c.stats.dryRun.Load(),
+		EmptyFlushesSkipped: c.stats.emptySkipped.Load(),
+		Buffered:            c.stats.buffered.Load(),
+		BufferedBytes:       c.stats.bufferedBytes.Load(),
+		BreakerState:        c.breakerState(),
+	}
+}
+
+// Reset discards buffered messages and zeroes the statistics, keeping
+// configuration, tags and defaults. In-flight flushes are not affected.
+func (c *Client) Reset() {
+	if c.root != nil {
+		c.root.Reset()
+		return
+	}
+
+	c.setup()
+	c.Lock()
+	defer c.Unlock()
+
+	c.buffer = nil
+	c.seen = nil
+	c.size = 0
+	c.reported = 0
+	c.stats.reset()
+	c.space.Broadcast()
+}
+
+// Update the buffer gauges. Must be called with the lock held.
+func (c *Client) gauge() {
+	c.stats.buffered.Store(uint64(len(c.buffer)))
+	c.stats.bufferedBytes.Store(uint64(c.size))
+}